@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/GoogleCloudPlatform/abelana-gcp/imagemagick/blobstore"
+)
+
+// bucketWatcher polls a local bucket and posts an object change notification to notice for
+// every object that appears or changes, like Cloud Storage does for the uploads bucket.
+type bucketWatcher struct {
+	store  *blobstore.Local
+	bucket string
+	notify string
+	token  string // of the notification channel
+	seen   map[string]*blobstore.ObjectInfo
+}
+
+func newBucketWatcher(root, bucket, notify, token string) *bucketWatcher {
+	return &bucketWatcher{
+		store:  blobstore.NewLocal(root),
+		bucket: bucket,
+		notify: notify,
+		token:  token,
+		seen:   make(map[string]*blobstore.ObjectInfo),
+	}
+}
+
+func (b *bucketWatcher) run(every time.Duration) {
+	for {
+		b.poll()
+		time.Sleep(every)
+	}
+}
+
+func (b *bucketWatcher) poll() {
+	names, err := b.store.List(b.bucket, "")
+	if err != nil {
+		log.Printf("list %s: %v", b.bucket, err)
+		return
+	}
+	exists := make(map[string]bool)
+	for _, name := range names {
+		exists[name] = true
+		info, err := b.store.Stat(b.bucket, name)
+		if err != nil {
+			continue
+		}
+		if old, ok := b.seen[name]; ok && old.Updated.Equal(info.Updated) {
+			continue
+		}
+		if err := b.post(info, "exists"); err != nil {
+			log.Printf("notify %s/%s: %v", b.bucket, name, err)
+			continue
+		}
+		b.seen[name] = info
+	}
+	for name, info := range b.seen {
+		if exists[name] {
+			continue
+		}
+		if err := b.post(info, "not_exists"); err != nil {
+			log.Printf("notify %s/%s: %v", b.bucket, name, err)
+			continue
+		}
+		delete(b.seen, name)
+	}
+}
+
+// post sends the notification, with the fields of the Cloud Storage object resource notice reads.
+// state is "exists" or "not_exists", as in the X-Goog-Resource-State header.
+func (b *bucketWatcher) post(info *blobstore.ObjectInfo, state string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"kind":        "storage#object",
+		"bucket":      info.Bucket,
+		"name":        info.Name,
+		"contentType": info.ContentType,
+		"size":        info.Size,
+		"generation":  fmt.Sprint(info.Updated.UnixNano()),
+		"updated":     info.Updated.UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", b.notify, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Goog-Resource-State", state)
+	req.Header.Set("X-Goog-Channel-Token", b.token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("notice replied %s", res.Status)
+	}
+	log.Printf("notified %s/%s %s", info.Bucket, info.Name, state)
+	return nil
+}
@@ -0,0 +1,268 @@
+// Command devharness runs the whole photo pipeline on a development machine: the App Engine
+// modules under the development server, imagemagick, and a redis-server, wired together with
+// local stand-ins for Cloud Storage, its object change notifications and the token info service.
+//
+// Run it from the root of the repository:
+//
+//	devharness                # boot everything and keep serving until interrupted
+//	devharness -scenarios     # boot everything, run the scenarios and exit
+//
+// Uploads are files written to <root>/<uploads>/, as if a client had put them in the bucket.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Where things listen, notice sends images to the imagemagick in its DevBackends.
+const (
+	appServerPort   = 8080
+	adminPort       = 8000
+	imagemagickAddr = "localhost:8090"
+	tokenInfoAddr   = "localhost:8091"
+)
+
+var (
+	repo        = flag.String("repo", ".", "root of the abelana-gcp repository")
+	root        = flag.String("root", "", "directory holding the local buckets, defaults to a temporary directory")
+	uploads     = flag.String("uploads", "", "bucket the clients upload their photos to, defaults to the UploadsBucket of notice")
+	appServer   = flag.String("appserver", "dev_appserver.py", "App Engine development server")
+	imagemagick = flag.String("imagemagick", "imagemagick", "imagemagick server binary")
+	redisServer = flag.String("redis", "redis-server", "redis server binary")
+	runTests    = flag.Bool("scenarios", false, "run the scenarios and exit")
+)
+
+// noticeConfig is the part of notice/config.json the harness cares about.
+type noticeConfig struct {
+	DevChannelToken string
+	UploadsBucket   string
+}
+
+// endpointsConfig is the part of endpoints/private/abelana-config.json the harness cares about.
+type endpointsConfig struct {
+	AuthEmail      string
+	Bucket         string
+	RedisPW        string
+	Redis          string
+	StorageKind    string
+	StorageDir     string
+	EnableBackdoor bool
+}
+
+func main() {
+	flag.Parse()
+	rand.Seed(time.Now().UnixNano())
+	if *root == "" {
+		dir, err := ioutil.TempDir("", "abelana-dev")
+		if err != nil {
+			log.Fatal(err)
+		}
+		*root = dir
+	}
+	var err error
+	if *root, err = filepath.Abs(*root); err != nil {
+		log.Fatal(err)
+	}
+
+	ecfg, err := readEndpointsConfig(filepath.Join(*repo, "endpoints", "private", "abelana-config.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	ncfg, err := readNoticeConfig(filepath.Join(*repo, "notice", "config.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	imcfg, err := writeImagemagickConfig(ecfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var procs processes
+	defer procs.stop()
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGTERM, os.Interrupt)
+		<-c
+		procs.stop()
+		os.Exit(1)
+	}()
+
+	go func() {
+		log.Fatal(http.ListenAndServe(tokenInfoAddr, tokenInfoHandler(ecfg.AuthEmail)))
+	}()
+
+	_, redisPort, _ := net.SplitHostPort(ecfg.Redis)
+	steps := []struct {
+		name  string
+		args  []string
+		ready func() error
+	}{
+		{"redis", []string{*redisServer, "--port", redisPort, "--requirepass", ecfg.RedisPW, "--save", ""},
+			func() error { return dial(ecfg.Redis) }},
+		{"imagemagick", []string{*imagemagick, "-listen", imagemagickAddr, "-account", "", "-config", imcfg},
+			func() error { return get("http://" + imagemagickAddr + "/healthcheck") }},
+		{"appserver", []string{*appServer,
+			"--port", fmt.Sprint(appServerPort), "--admin_port", fmt.Sprint(adminPort),
+			"--storage_path", filepath.Join(*root, ".appserver"), "--clear_datastore",
+			filepath.Join(*repo, "default", "dispatch.yaml"),
+			filepath.Join(*repo, "default", "app.yaml"),
+			filepath.Join(*repo, "endpoints", "app.yaml"),
+			filepath.Join(*repo, "notice", "app.yaml")},
+			func() error { return reachable(fmt.Sprintf("http://localhost:%d/v2/user/-/stats", appServerPort)) }},
+	}
+	for _, s := range steps {
+		if err := procs.start(s.name, s.args...); err != nil {
+			log.Fatalf("start %s: %v", s.name, err)
+		}
+		if err := waitFor(2*time.Minute, s.ready); err != nil {
+			log.Fatalf("%s not ready: %v", s.name, err)
+		}
+		log.Printf("%s ready", s.name)
+	}
+
+	b := newBucketWatcher(*root, *uploads, fmt.Sprintf("http://localhost:%d/notice/object-change", appServerPort), ncfg.DevChannelToken)
+	go b.run(500 * time.Millisecond)
+	log.Printf("upload photos to %s", filepath.Join(*root, *uploads))
+
+	if !*runTests {
+		select {}
+	}
+	h := &harness{
+		base:    fmt.Sprintf("http://localhost:%d/v2", appServerPort),
+		root:    *root,
+		uploads: *uploads,
+		output:  ecfg.Bucket,
+	}
+	if !h.runScenarios() {
+		procs.stop()
+		os.Exit(1)
+	}
+}
+
+// readEndpointsConfig reads the endpoints config and checks it points at the local stand-ins, we
+// don't rewrite it as it is the developer's own.
+func readEndpointsConfig(path string) (*endpointsConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg endpointsConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", path, err)
+	}
+	var problems []string
+	if !cfg.EnableBackdoor {
+		problems = append(problems, `"EnableBackdoor": true`)
+	}
+	if cfg.StorageKind != "local" || cfg.StorageDir != *root {
+		problems = append(problems, fmt.Sprintf(`"StorageKind": "local", "StorageDir": %q`, *root))
+	}
+	if h, _, err := net.SplitHostPort(cfg.Redis); err != nil || (h != "localhost" && h != "127.0.0.1") {
+		problems = append(problems, `"Redis": "localhost:6379"`)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%s must be set up for local development with %s", path, strings.Join(problems, ", "))
+	}
+	return &cfg, nil
+}
+
+// readNoticeConfig reads the notice config, the harness notifies it as a legacy channel of the
+// uploads bucket would.
+func readNoticeConfig(path string) (*noticeConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg noticeConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", path, err)
+	}
+	if cfg.DevChannelToken == "" {
+		return nil, fmt.Errorf(`%s must be set up for local development with a "DevChannelToken"`, path)
+	}
+	if *uploads == "" {
+		*uploads = cfg.UploadsBucket
+	}
+	if *uploads != cfg.UploadsBucket {
+		return nil, fmt.Errorf("notice only handles uploads to %q, not %q", cfg.UploadsBucket, *uploads)
+	}
+	return &cfg, nil
+}
+
+// writeImagemagickConfig copies the imagemagick config, renditions and limits included, pointing
+// it at the local stand-ins.  It returns the path of the copy.
+func writeImagemagickConfig(ecfg *endpointsConfig) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(*repo, "imagemagick", "config.json"))
+	if err != nil {
+		return "", err
+	}
+	var cfg map[string]interface{}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return "", fmt.Errorf("parse imagemagick config: %v", err)
+	}
+	cfg["InputBucket"] = *uploads
+	cfg["OutputBucket"] = ecfg.Bucket
+	cfg["PushURL"] = fmt.Sprintf("http://localhost:%d/photopush/", appServerPort)
+	cfg["AuthEmail"] = ecfg.AuthEmail
+	cfg["TokenInfoURL"] = "http://" + tokenInfoAddr + "/"
+	cfg["Storage"] = map[string]string{"Kind": "local", "Dir": *root}
+	if b, err = json.MarshalIndent(cfg, "", "\t"); err != nil {
+		return "", err
+	}
+	path := filepath.Join(*root, "imagemagick.json")
+	return path, ioutil.WriteFile(path, b, 0644)
+}
+
+// waitFor calls f until it succeeds or the timeout expires.
+func waitFor(timeout time.Duration, f func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := f()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+func dial(addr string) error {
+	c, err := net.Dial("tcp", addr)
+	if err == nil {
+		c.Close()
+	}
+	return err
+}
+
+// reachable reports whether url answers at all, whatever the status.
+func reachable(url string) error {
+	res, err := http.Get(url)
+	if err == nil {
+		res.Body.Close()
+	}
+	return err
+}
+
+func get(url string) error {
+	res, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// processes are the subprocesses of the harness, their output is logged with their name.
+type processes struct {
+	mu   sync.Mutex
+	cmds []*exec.Cmd
+}
+
+func (p *processes) start(name string, args ...string) error {
+	cmd := exec.Command(args[0], args[1:]...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go prefixLines(name, out)
+
+	p.mu.Lock()
+	p.cmds = append(p.cmds, cmd)
+	p.mu.Unlock()
+	return nil
+}
+
+// stop terminates the subprocesses, the last started first, killing the ones that take too long.
+func (p *processes) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := len(p.cmds) - 1; i >= 0; i-- {
+		cmd := p.cmds[i]
+		cmd.Process.Signal(syscall.SIGTERM)
+		done := make(chan bool)
+		go func() {
+			cmd.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			cmd.Process.Kill()
+		}
+	}
+	p.cmds = nil
+}
+
+func prefixLines(name string, r io.Reader) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		log.Printf("[%s] %s", name, s.Text())
+	}
+}
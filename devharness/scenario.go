@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/abelana-gcp/imagemagick/blobstore"
+)
+
+// pipelineTimeout is how long a photo may take from upload to timeline, the task queue of the
+// development server is slow to start.
+const pipelineTimeout = time.Minute
+
+// harness talks to the services the way the clients do.
+type harness struct {
+	base    string // API root, with the version
+	root    string
+	uploads string
+	output  string
+}
+
+type scenario struct {
+	name string
+	run  func(h *harness) error
+}
+
+var scenarios = []scenario{
+	{"photo reaches the timelines of followers", followerSeesPhoto},
+	{"photo shows up in the uploader's profile", uploaderSeesPhoto},
+	{"renditions are written to the output bucket", renditionsWritten},
+	{"renditions are written in every format", renditionFormats},
+	{"non images never reach the timeline", nonImageRejected},
+	{"deleted photos leave the timelines", deletedPhotoRetired},
+}
+
+// runScenarios runs every scenario and reports whether they all passed.
+func (h *harness) runScenarios() bool {
+	ok := true
+	for _, s := range scenarios {
+		start := time.Now()
+		if err := s.run(h); err != nil {
+			log.Printf("FAIL %s: %v", s.name, err)
+			ok = false
+			continue
+		}
+		log.Printf("ok   %s (%v)", s.name, time.Since(start))
+	}
+	return ok
+}
+
+func followerSeesPhoto(h *harness) error {
+	alice, err := h.login("alice")
+	if err != nil {
+		return err
+	}
+	bob, err := h.login("bob")
+	if err != nil {
+		return err
+	}
+	if err := h.call("PUT", "/user/"+bob.atok+"/following/"+alice.id, nil); err != nil {
+		return fmt.Errorf("follow: %v", err)
+	}
+	photoID, err := h.upload(alice.id, testJPEG())
+	if err != nil {
+		return err
+	}
+	return h.waitForEntry(bob, "/user/"+bob.atok+"/timeline/0", photoID)
+}
+
+func uploaderSeesPhoto(h *harness) error {
+	carol, err := h.login("carol")
+	if err != nil {
+		return err
+	}
+	photoID, err := h.upload(carol.id, testJPEG())
+	if err != nil {
+		return err
+	}
+	if err := h.waitForEntry(carol, "/user/"+carol.atok+"/profile/0", photoID); err != nil {
+		return err
+	}
+	st, err := h.status(carol, photoID)
+	if err != nil {
+		return err
+	}
+	if st.Status != "ready" || len(st.Renditions) == 0 {
+		return fmt.Errorf("status of %s: %+v", photoID, st)
+	}
+	return nil
+}
+
+func renditionsWritten(h *harness) error {
+	dave, err := h.login("dave")
+	if err != nil {
+		return err
+	}
+	photoID, err := h.upload(dave.id, testJPEG())
+	if err != nil {
+		return err
+	}
+	store := blobstore.NewLocal(h.root)
+	return waitFor(pipelineTimeout, func() error {
+		names, err := store.List(h.output, photoID+"_")
+		if err != nil {
+			return err
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("no renditions of %s", photoID)
+		}
+		return nil
+	})
+}
+
+// magic are the first bytes of the files of each extension, "?" matches any byte.
+var magic = map[string]string{
+	"webp": "RIFF????WEBP",
+	"jpeg": "\xff\xd8\xff",
+	"png":  "\x89PNG\r\n\x1a\n",
+	"gif":  "GIF8",
+	"avif": "????ftypavif",
+}
+
+func renditionFormats(h *harness) error {
+	frank, err := h.login("frank")
+	if err != nil {
+		return err
+	}
+	photoID, err := h.upload(frank.id, testJPEG())
+	if err != nil {
+		return err
+	}
+	if err := h.waitForEntry(frank, "/user/"+frank.atok+"/profile/0", photoID); err != nil {
+		return err
+	}
+	st, err := h.status(frank, photoID)
+	if err != nil {
+		return err
+	}
+	if len(st.Formats) == 0 {
+		return fmt.Errorf("no formats in the status of %s", photoID)
+	}
+	store := blobstore.NewLocal(h.root)
+	for suffix, exts := range st.Formats {
+		for _, ext := range exts {
+			name := fmt.Sprintf("%s_%s.%s", photoID, suffix, ext)
+			r, err := store.Get(h.output, name)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			head := make([]byte, 16)
+			n, _ := io.ReadFull(r, head)
+			r.Close()
+			if !hasMagic(head[:n], magic[ext]) {
+				return fmt.Errorf("%s starts with %q, not a %s", name, head[:n], ext)
+			}
+		}
+	}
+	return nil
+}
+
+func hasMagic(b []byte, m string) bool {
+	if m == "" || len(b) < len(m) {
+		return false
+	}
+	for i := 0; i < len(m); i++ {
+		if m[i] != '?' && m[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func nonImageRejected(h *harness) error {
+	erin, err := h.login("erin")
+	if err != nil {
+		return err
+	}
+	bad, err := h.upload(erin.id, []byte("this is not a photo"))
+	if err != nil {
+		return err
+	}
+	// The bad upload was queued first, by the time a later good one is in the profile it has had
+	// its turn.
+	good, err := h.upload(erin.id, testJPEG())
+	if err != nil {
+		return err
+	}
+	if err := h.waitForEntry(erin, "/user/"+erin.atok+"/profile/0", good); err != nil {
+		return err
+	}
+	tl, err := h.timeline("/user/" + erin.atok + "/profile/0")
+	if err != nil {
+		return err
+	}
+	if tl.has(bad) {
+		return fmt.Errorf("%s is in the profile", bad)
+	}
+	return waitFor(pipelineTimeout, func() error {
+		st, err := h.status(erin, bad)
+		if err != nil {
+			return err
+		}
+		if st.Status != "failed" {
+			return fmt.Errorf("status of %s: %+v", bad, st)
+		}
+		return nil
+	})
+}
+
+func deletedPhotoRetired(h *harness) error {
+	frank, err := h.login("frank")
+	if err != nil {
+		return err
+	}
+	photoID, err := h.upload(frank.id, testJPEG())
+	if err != nil {
+		return err
+	}
+	path := "/user/" + frank.atok + "/timeline/0"
+	if err := h.waitForEntry(frank, path, photoID); err != nil {
+		return err
+	}
+	store := blobstore.NewLocal(h.root)
+	if err := store.Delete(h.uploads, photoID+".jpg"); err != nil {
+		return err
+	}
+	return waitFor(pipelineTimeout, func() error {
+		tl, err := h.timeline(path)
+		if err != nil {
+			return err
+		}
+		if tl.has(photoID) {
+			return fmt.Errorf("%s still in the timeline", photoID)
+		}
+		names, err := store.List(h.output, photoID+"_")
+		if err != nil {
+			return err
+		}
+		if len(names) > 0 {
+			return fmt.Errorf("%d renditions of %s left", len(names), photoID)
+		}
+		return nil
+	})
+}
+
+// user is someone logged in through the development backdoor.
+type user struct {
+	id   string
+	atok string
+}
+
+// login logs in a new user, ids are made unique so the scenarios can be run again against the
+// same datastore.
+func (h *harness) login(name string) (*user, error) {
+	id := fmt.Sprintf("%s%d", name, time.Now().UnixNano())
+	seg := func(s string) string {
+		return strings.TrimRight(base64.URLEncoding.EncodeToString([]byte(s)), "=")
+	}
+	var tok struct {
+		Atok string `json:"atok"`
+	}
+	if err := h.call("GET", "/user/Dev"+id+"/login/"+seg(name)+"/"+seg("null"), &tok); err != nil {
+		return nil, fmt.Errorf("login %s: %v", name, err)
+	}
+	return &user{id, tok.Atok}, nil
+}
+
+// upload puts a photo in the uploads bucket, the way the clients name them, and returns its id.
+func (h *harness) upload(userID string, b []byte) (string, error) {
+	photoID := fmt.Sprintf("%s.%d", userID, rand.Int63())
+	err := blobstore.NewLocal(h.root).Put(h.uploads, photoID+".jpg", "image/jpeg", bytes.NewReader(b))
+	if err != nil {
+		return "", fmt.Errorf("upload: %v", err)
+	}
+	return photoID, nil
+}
+
+type timeline struct {
+	Entries []struct {
+		PhotoID string `json:"photoid"`
+	} `json:"entries"`
+}
+
+func (t *timeline) has(photoID string) bool {
+	for _, e := range t.Entries {
+		if e.PhotoID == photoID {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *harness) timeline(path string) (*timeline, error) {
+	var tl timeline
+	err := h.call("GET", path, &tl)
+	return &tl, err
+}
+
+type photoStatus struct {
+	Status     string              `json:"status"`
+	Renditions []string            `json:"renditions"`
+	Formats    map[string][]string `json:"formats"`
+	Reason     string              `json:"reason"`
+}
+
+func (h *harness) status(u *user, photoID string) (*photoStatus, error) {
+	var st photoStatus
+	err := h.call("GET", "/photo/"+u.atok+"/"+photoID+"/status", &st)
+	return &st, err
+}
+
+// waitForEntry waits for photoID to show up in the timeline at path.
+func (h *harness) waitForEntry(u *user, path, photoID string) error {
+	return waitFor(pipelineTimeout, func() error {
+		tl, err := h.timeline(path)
+		if err != nil {
+			return err
+		}
+		if !tl.has(photoID) {
+			return fmt.Errorf("%s not in %s of %s", photoID, path, u.id)
+		}
+		return nil
+	})
+}
+
+// call makes an API call, decoding the reply into v unless it's nil.
+func (h *harness) call(method, path string, v interface{}) error {
+	req, err := http.NewRequest(method, h.base+path, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", method, path, res.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// testJPEG returns a small photo, a grid of random colours so no two uploads are the same, not
+// even to the perceptual hash that spots duplicates.
+func testJPEG() []byte {
+	const cell = 40
+	img := image.NewRGBA(image.Rect(0, 0, 640, 480))
+	for cy := 0; cy < 480; cy += cell {
+		for cx := 0; cx < 640; cx += cell {
+			c := color.RGBA{uint8(rand.Intn(256)), uint8(rand.Intn(256)), uint8(rand.Intn(256)), 255}
+			for y := cy; y < cy+cell; y++ {
+				for x := cx; x < cx+cell; x++ {
+					img.Set(x, y, c)
+				}
+			}
+		}
+	}
+	var b bytes.Buffer
+	jpeg.Encode(&b, img, nil)
+	return b.Bytes()
+}
@@ -0,0 +1,216 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package abelana
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+
+	"appengine"
+
+	"github.com/go-martini/martini"
+)
+
+// defaultBatchSize is used when the config doesn't set BatchMaxSize.
+const defaultBatchSize = 20
+
+// batchable lists the routes that may be part of a batch, "*" matches any single path segment.
+// The :atok segment of a sub request is ignored, the batch itself has already been authorized.
+var batchable = []struct{ method, path string }{
+	{"GET", "/user/*/timeline/*"},
+	{"GET", "/user/*/profile/*"},
+	{"GET", "/user/*/following"},
+	{"GET", "/user/*/following/*"},
+	{"GET", "/user/*/following/*/profile/*"},
+	{"GET", "/user/*/stats"},
+	{"GET", "/photo/*/*/comments"},
+	{"GET", "/photo/*/*/status"},
+	{"PUT", "/photo/*/*/like"},
+	{"DELETE", "/photo/*/*/like"},
+}
+
+type (
+	// BatchRequest is one of the operations of a batch.
+	BatchRequest struct {
+		Method string          `json:"method"`
+		Path   string          `json:"path"`
+		Body   json.RawMessage `json:"body,omitempty"`
+	}
+
+	// BatchResponse is the result of a single BatchRequest.
+	BatchResponse struct {
+		Status int             `json:"status"`
+		Body   json.RawMessage `json:"body,omitempty"`
+	}
+
+	// Batch is returned from a POST to /batch, Responses are in the order of the requests.
+	Batch struct {
+		Kind      string          `json:"kind"`
+		Responses []BatchResponse `json:"responses"`
+	}
+)
+
+// batchCalls holds the context and access token of the sub requests currently being served, so
+// that they don't need to go through appengine.NewContext and Aauth again.  They are keyed by the
+// request pointer, which can't be forged from outside.
+var batchCalls = struct {
+	sync.Mutex
+	m map[*http.Request]*batchCall
+}{m: make(map[*http.Request]*batchCall)}
+
+type batchCall struct {
+	cx appengine.Context
+	at Access
+}
+
+// batchCallFor returns the batch call r is part of, or nil.
+func batchCallFor(r *http.Request) *batchCall {
+	batchCalls.Lock()
+	defer batchCalls.Unlock()
+	return batchCalls.m[r]
+}
+
+// requestContext returns the appengine.Context for r, sub requests share the one of their batch.
+func requestContext(r *http.Request) appengine.Context {
+	if bc := batchCallFor(r); bc != nil {
+		return bc.cx
+	}
+	return appengine.NewContext(r)
+}
+
+// PostBatch runs several API calls with a single authorization, in order, or in parallel when
+// called with ?parallel=1. ([]BatchRequest) : Batch
+func PostBatch(cx appengine.Context, at Access, w http.ResponseWriter, r *http.Request) {
+	var reqs []BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		http.Error(w, fmt.Sprintf("invalid batch: %v", err), http.StatusBadRequest)
+		return
+	}
+	max := abelanaConfig().BatchMaxSize
+	if max <= 0 {
+		max = defaultBatchSize
+	}
+	if len(reqs) > max {
+		http.Error(w, fmt.Sprintf("batch too large, at most %d requests", max), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Sub requests are served by the same API version as the batch.
+	prefix := "/" + replyVersion(w)
+
+	res := make([]BatchResponse, len(reqs))
+	if r.FormValue("parallel") == "1" {
+		var wg sync.WaitGroup
+		for i := range reqs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				res[i] = runBatchRequest(cx, at, prefix, r.Header, &reqs[i])
+			}(i)
+		}
+		wg.Wait()
+	} else {
+		for i := range reqs {
+			res[i] = runBatchRequest(cx, at, prefix, r.Header, &reqs[i])
+		}
+	}
+	replyJSON(w, &Batch{"abelana#batch", res})
+}
+
+// runBatchRequest serves a single sub request through the API router, it is negotiated with the
+// Accept header of the batch.
+func runBatchRequest(cx appengine.Context, at Access, prefix string, h http.Header, br *BatchRequest) BatchResponse {
+	method := strings.ToUpper(br.Method)
+	if !isBatchable(method, br.Path) {
+		return batchError(http.StatusForbidden, "route can't be batched")
+	}
+	rq, err := http.NewRequest(method, prefix+br.Path, bytes.NewReader(br.Body))
+	if err != nil {
+		return batchError(http.StatusBadRequest, err.Error())
+	}
+	rq.Header.Set("Content-Type", "application/json")
+	rq.Header.Set("Accept", h.Get("Accept"))
+
+	batchCalls.Lock()
+	batchCalls.m[rq] = &batchCall{cx, at}
+	batchCalls.Unlock()
+	defer func() {
+		batchCalls.Lock()
+		delete(batchCalls.m, rq)
+		batchCalls.Unlock()
+	}()
+
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, rq)
+
+	body := bytes.TrimSpace(rec.Body.Bytes())
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+		body, _ = json.Marshal(string(body))
+	}
+	return BatchResponse{Status: rec.Code, Body: body}
+}
+
+func batchError(code int, msg string) BatchResponse {
+	b, _ := json.Marshal(msg)
+	return BatchResponse{Status: code, Body: b}
+}
+
+// isBatchable checks the method and path against the batchable list, the query string doesn't
+// matter.  Paths climbing out of a segment with . or .. are never batchable.
+func isBatchable(method, path string) bool {
+	u, err := url.Parse(path)
+	if err != nil {
+		return false
+	}
+	segs := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for _, s := range segs {
+		if s == "." || s == ".." {
+			return false
+		}
+	}
+outer:
+	for _, b := range batchable {
+		if b.method != method {
+			continue
+		}
+		pat := strings.Split(strings.Trim(b.path, "/"), "/")
+		if len(pat) != len(segs) {
+			continue
+		}
+		for i := range pat {
+			if pat[i] != "*" && pat[i] != segs[i] {
+				continue outer
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// batchAuth maps the access token of the batch for its sub requests, it reports whether r is one.
+func batchAuth(c martini.Context, r *http.Request) bool {
+	bc := batchCallFor(r)
+	if bc == nil {
+		return false
+	}
+	c.MapTo(bc.at, (*Access)(nil))
+	return true
+}
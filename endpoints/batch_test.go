@@ -0,0 +1,195 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package abelana
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/inject"
+	"github.com/go-martini/martini"
+)
+
+func TestIsBatchable(t *testing.T) {
+	for _, tt := range []struct {
+		method, path string
+		ok           bool
+	}{
+		{"GET", "/user/x/timeline/0", true},
+		{"GET", "/user/x/timeline/0?renditions=a", true},
+		{"GET", "/user/x/following/y/profile/0", true},
+		{"PUT", "/photo/x/1.2/like", true},
+		{"DELETE", "/photo/x/1.2/like", true},
+		{"POST", "/user/x/timeline/0", false},
+		{"GET", "/photo/x/1.2/flag", false},
+		{"GET", "/user/x/timeline", false},
+		{"GET", "/user/x/timeline/0/more", false},
+		{"GET", "/user/x/timeline/..", false},
+		{"GET", "/user/x/profile/.", false},
+		{"GET", "/user/x/../y/stats", false},
+		{"GET", "/admin/flagged", false},
+		{"POST", "/batch/x", false},
+	} {
+		if ok := isBatchable(tt.method, tt.path); ok != tt.ok {
+			t.Errorf("isBatchable(%s, %q) = %v, want %v", tt.method, tt.path, ok, tt.ok)
+		}
+	}
+}
+
+// injected stands in for martini, it records what Aauth maps.
+type injected struct {
+	martini.Context
+	at Access
+}
+
+func (c *injected) MapTo(v interface{}, _ interface{}) inject.TypeMapper {
+	c.at = v.(Access)
+	return c
+}
+
+// fakeAPI serves sub requests in place of the router: it authorizes them with the atok of their
+// path and replies with who they were served for.  wait, if set, runs before replying.
+func fakeAPI(wait func(path string)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := &injected{}
+		Aauth(c, nil, martini.Params{"atok": strings.Split(r.URL.Path, "/")[3]}, w, r)
+		if c.at == nil {
+			return
+		}
+		if wait != nil {
+			wait(r.URL.Path)
+		}
+		replyJSON(w, map[string]string{"user": c.at.ID(), "path": r.URL.Path})
+	})
+}
+
+// postBatch runs a batch of GETs of paths for user 00042 and returns the responses.
+func postBatch(t *testing.T, query string, paths ...string) (int, []BatchResponse) {
+	reqs := make([]BatchRequest, len(paths))
+	for i, p := range paths {
+		reqs[i] = BatchRequest{Method: "get", Path: p}
+	}
+	b, _ := json.Marshal(reqs)
+	r, _ := http.NewRequest("POST", "/v2/batch/atok"+query, strings.NewReader(string(b)))
+	w := httptest.NewRecorder()
+	PostBatch(nil, &AccToken{UserID: "00042"}, w, r)
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+	var batch Batch
+	if err := json.Unmarshal(w.Body.Bytes(), &batch); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, batch.Responses
+}
+
+// checkResponses checks that every path was served, in order, for the user of the batch.
+func checkResponses(t *testing.T, name string, res []BatchResponse, paths ...string) {
+	if len(res) != len(paths) {
+		t.Fatalf("%s: %d responses, want %d", name, len(res), len(paths))
+	}
+	for i, br := range res {
+		var got struct{ User, Path string }
+		if br.Status != http.StatusOK {
+			t.Errorf("%s: %s status %d %s", name, paths[i], br.Status, br.Body)
+			continue
+		}
+		if err := json.Unmarshal(br.Body, &got); err != nil {
+			t.Errorf("%s: %s %v", name, paths[i], err)
+			continue
+		}
+		if want := "/" + apiCurrent + strings.Split(paths[i], "?")[0]; got.Path != want {
+			t.Errorf("%s: response %d is for %s, want %s", name, i, got.Path, want)
+		}
+		if got.User != "00042" {
+			t.Errorf("%s: %s served for %q, want the batch's user", name, paths[i], got.User)
+		}
+	}
+}
+
+func TestPostBatch(t *testing.T) {
+	saved := api
+	defer func() { api = saved }()
+
+	// The atoks of the paths aren't tokens at all, the batch's Access is used instead.
+	paths := []string{"/user/junk/stats", "/user/x/timeline/0", "/user/..x/following", "/photo/x/1.2/comments"}
+
+	var mu sync.Mutex
+	var served []string
+	api = fakeAPI(func(path string) {
+		mu.Lock()
+		served = append(served, path)
+		mu.Unlock()
+	})
+	_, res := postBatch(t, "", paths...)
+	checkResponses(t, "ordered", res, paths...)
+	for i, p := range served {
+		if want := "/" + apiCurrent + paths[i]; p != want {
+			t.Errorf("ordered: served %s at %d, want %s", p, i, want)
+		}
+	}
+
+	// In parallel every sub request waits for all the others to start, and the first ones are
+	// the last to finish; the responses still come in the order of the requests.
+	var started sync.WaitGroup
+	started.Add(len(paths))
+	all := make(chan struct{})
+	go func() {
+		started.Wait()
+		close(all)
+	}()
+	api = fakeAPI(func(path string) {
+		started.Done()
+		select {
+		case <-all:
+		case <-time.After(5 * time.Second):
+			t.Errorf("parallel: %s waited for the others in vain", path)
+			return
+		}
+		for i, p := range paths {
+			if path == "/"+apiCurrent+p {
+				time.Sleep(time.Duration(len(paths)-i) * 10 * time.Millisecond)
+			}
+		}
+	})
+	_, res = postBatch(t, "?parallel=1", paths...)
+	checkResponses(t, "parallel", res, paths...)
+
+	// Sub requests that can't be batched are refused one by one.
+	api = fakeAPI(nil)
+	_, res = postBatch(t, "", "/user/x/stats", "/admin/flagged")
+	if len(res) != 2 || res[0].Status != http.StatusOK || res[1].Status != http.StatusForbidden {
+		t.Errorf("batch with a forbidden route: %+v", res)
+	}
+}
+
+func TestPostBatchTooLarge(t *testing.T) {
+	saved, savedAPI := config, api
+	config = &AbelanaConfig{BatchMaxSize: 2}
+	api = fakeAPI(nil)
+	defer func() { config, api = saved, savedAPI }()
+
+	if code, _ := postBatch(t, "", "/user/x/stats", "/user/x/stats"); code != http.StatusOK {
+		t.Errorf("batch of BatchMaxSize: status %d", code)
+	}
+	if code, _ := postBatch(t, "", "/user/x/stats", "/user/x/stats", "/user/x/stats"); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("batch over BatchMaxSize: status %d, want %d", code, http.StatusRequestEntityTooLarge)
+	}
+}
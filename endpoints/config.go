@@ -8,17 +8,31 @@ import (
 
 // AbelanaConfig contains all the information we need to run Abelana
 type AbelanaConfig struct {
-	AuthEmail         string
-	ProjectID         string
-	Bucket            string
-	RedisPW           string
-	Redis             string
-	ServerKey         string
-	AutoFollowers     []string
-	Silhouette        string
-	TimelineBatchSize int
-	UploadRetries     int
-	EnableBackdoor    bool
+	AuthEmail             string
+	ProjectID             string
+	Bucket                string
+	RedisPW               string
+	Redis                 string
+	ServerKey             string
+	AutoFollowers         []string
+	Silhouette            string
+	TimelineBatchSize     int
+	UploadRetries         int
+	BatchMaxSize          int
+	StorageKind           string   // "gcs", the default, or "local"
+	StorageDir            string   // root of the local store
+	UploadBucket          string   // where clients upload their photos with the URLs of PostUpload
+	UploadMaxBytes        int64    // largest upload, defaults to 20MB
+	UploadExpirySeconds   int      // how long upload URLs are valid, defaults to 15 minutes
+	RenditionBucket       string   // where imagemagick writes the renditions, no URLs are signed if empty
+	Renditions            []string // suffixes of the renditions clients may ask URLs for
+	RenditionExt          string   // extension of the renditions, defaults to webp
+	DownloadExpirySeconds int      // how long rendition URLs are valid, defaults to an hour
+	DuplicateDistance     int      // bits a dHash may differ by to be a copy, defaults to 6
+	ProxyURL              string   // base of the imagemagick on-demand renditions, "https://host/img/"
+	ProxyKey              string   // the Key of its Proxy config, no on-demand URLs are signed if empty
+	ProxyFormats          []string // extensions it renders in, defaults to webp and jpeg
+	EnableBackdoor        bool
 }
 
 var config = mustLoadConfig("private/abelana-config.json")
@@ -0,0 +1,306 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package abelana
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+
+	"github.com/go-martini/martini"
+)
+
+// The rendition bucket is private, clients fetch the renditions with signed URLs that we only
+// hand out to those allowed to see the photo.  The URLs are kept in memcache for half their
+// lifetime, so paging through a timeline doesn't sign the same objects over and over and every
+// URL we hand out is good for at least half of DownloadExpirySeconds.
+
+const (
+	defaultDownloadExpiry = time.Hour
+	defaultRenditionExt   = "webp"
+)
+
+// canSee reports whether viewer may see the photos of owner: they are the owner, the account is
+// public or they follow it.
+func canSee(viewer string, owner *User) bool {
+	if viewer == owner.UserID || !owner.Private {
+		return true
+	}
+	for _, id := range owner.FollowsMe {
+		if id == viewer {
+			return true
+		}
+	}
+	return false
+}
+
+// SetVisibility makes the account public or private (Atok, public|private) : Status
+func SetVisibility(cx appengine.Context, at Access, p martini.Params, w http.ResponseWriter) {
+	var private bool
+	switch p["visibility"] {
+	case "public":
+	case "private":
+		private = true
+	default:
+		http.Error(w, "visibility is public or private", http.StatusBadRequest)
+		return
+	}
+	err := datastore.RunInTransaction(cx, func(cx appengine.Context) error {
+		u, err := findUser(cx, at.ID())
+		if err != nil {
+			return err
+		}
+		u.Private = private
+		if !private && len(u.FollowersAsk) > 0 {
+			// Anybody may follow a public account, those who asked don't have to wait any longer.
+			delayApproveFollowers.Call(cx, at.ID(), u.FollowersAsk)
+			u.FollowersAsk = nil
+		}
+		_, err = datastore.Put(cx, datastore.NewKey(cx, "User", at.ID(), 0, nil), u)
+		return err
+	}, nil)
+	if err != nil {
+		cx.Errorf("SetVisibility %v %v", at.ID(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	replyOk(w)
+}
+
+// downloadExpiry is how long the URLs we sign are valid.
+func downloadExpiry() time.Duration {
+	if s := abelanaConfig().DownloadExpirySeconds; s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return defaultDownloadExpiry
+}
+
+// renewal is how often, in seconds, the URLs we sign are renewed: half their lifetime, but at
+// least a second so a tiny DownloadExpirySeconds doesn't divide by zero.
+func renewal() int64 {
+	if half := int64(downloadExpiry() / 2 / time.Second); half > 0 {
+		return half
+	}
+	return 1
+}
+
+// urlEpoch changes whenever the cached URLs are renewed, it is part of the ETags of replies that
+// carry URLs so clients don't keep them past their expiry.
+func urlEpoch() string {
+	return strconv.FormatInt(time.Now().Unix()/renewal(), 36)
+}
+
+// wantedRenditions returns the rendition suffixes the client asked for with ?renditions=a,b, all
+// of them if it didn't say.  Suffixes we don't know are dropped.
+func wantedRenditions(r *http.Request) []string {
+	known := abelanaConfig().Renditions
+	q := r.FormValue("renditions")
+	if q == "" {
+		return known
+	}
+	var want []string
+	for _, s := range strings.Split(q, ",") {
+		for _, k := range known {
+			if s == k {
+				want = append(want, s)
+				break
+			}
+		}
+	}
+	return want
+}
+
+// signEntries fills in the URLs of the renditions the request wants for the entries viewer can
+// see, in the format its Accept header prefers, and the URL of the on-demand size it asks for.
+// Entries are left without URLs when anything goes wrong, the reply is still useful without them.
+// v1 replies drop the URLs, so it isn't called for them.
+func signEntries(cx appengine.Context, viewer string, tl []TLEntry, r *http.Request) {
+	cfg := abelanaConfig()
+	want, accept := wantedRenditions(r), r.Header.Get("Accept")
+	sized := sizedURL(cfg, r)
+	if cfg.RenditionBucket == "" {
+		want = nil
+	}
+	if len(tl) == 0 || (len(want) == 0 && sized == nil) {
+		return
+	}
+	ext := cfg.RenditionExt
+	if ext == "" {
+		ext = defaultRenditionExt
+	}
+	object := func(e *TLEntry, suffix string) string {
+		x := negotiate(accept, e.Formats[suffix])
+		if x == "" {
+			x = ext
+		}
+		return fmt.Sprintf("%s_%s.%s", e.PhotoID, suffix, x)
+	}
+
+	// Look up every owner once.
+	var keys []*datastore.Key
+	index := make(map[string]int)
+	for _, e := range tl {
+		if _, ok := index[e.UserID]; !ok {
+			index[e.UserID] = len(keys)
+			keys = append(keys, datastore.NewKey(cx, "User", e.UserID, 0, nil))
+		}
+	}
+	owners := make([]User, len(keys))
+	err := datastore.GetMulti(cx, keys, owners)
+	missing := make([]bool, len(keys))
+	if me, ok := err.(appengine.MultiError); ok {
+		for i, err := range me {
+			missing[i] = err != nil
+		}
+	} else if err != nil {
+		cx.Errorf("signEntries GetMulti %v", err)
+		return
+	}
+
+	var objects []string
+	for i := range tl {
+		o := index[tl[i].UserID]
+		if missing[o] || !canSee(viewer, &owners[o]) {
+			continue
+		}
+		if sized != nil {
+			tl[i].Sized = sized(tl[i].PhotoID)
+		}
+		for _, s := range want {
+			objects = append(objects, object(&tl[i], s))
+		}
+	}
+	urls := renditionURLs(cx, cfg.RenditionBucket, objects)
+
+	for i := range tl {
+		e := &tl[i]
+		for _, s := range want {
+			u, ok := urls[object(e, s)]
+			if !ok {
+				continue
+			}
+			if e.URLs == nil {
+				e.URLs = make(map[string]string)
+			}
+			e.URLs[s] = u.url
+			if e.Expires == 0 || u.expires < e.Expires {
+				e.Expires = u.expires
+			}
+		}
+	}
+}
+
+// sizedURL returns a function signing imagemagick URLs for the on-demand size the request asks
+// for with ?size=WxH&fit=, in the format its Accept header prefers.  It returns nil if there's
+// no size or the proxy isn't configured.  The URLs expire with the others of the epoch, so they
+// don't change within it, see urlEpoch.
+func sizedURL(cfg *AbelanaConfig, r *http.Request) func(photoID string) string {
+	size, fit := r.FormValue("size"), r.FormValue("fit")
+	if size == "" || cfg.ProxyURL == "" || cfg.ProxyKey == "" {
+		return nil
+	}
+	d := strings.Split(size, "x")
+	if len(d) != 2 {
+		return nil
+	}
+	formats := cfg.ProxyFormats
+	if len(formats) == 0 {
+		formats = defaultProxyFormats
+	}
+	format := negotiate(r.Header.Get("Accept"), formats)
+	half := renewal()
+	exp := strconv.FormatInt((time.Now().Unix()/half+2)*half, 10)
+	return func(photoID string) string {
+		return proxyURL(cfg, photoID, d[0], d[1], fit, format, exp)
+	}
+}
+
+// defaultProxyFormats are the formats imagemagick renders on demand when its config doesn't say.
+var defaultProxyFormats = []string{"webp", "jpeg"}
+
+// proxyURL returns the signed URL of an on-demand rendition, see imagemagick/proxy.go.
+func proxyURL(cfg *AbelanaConfig, photoID, w, h, fit, format, exp string) string {
+	m := hmac.New(sha256.New, []byte(cfg.ProxyKey))
+	io.WriteString(m, strings.Join([]string{photoID, w, h, fit, format, exp}, "\n"))
+	q := url.Values{"w": {w}, "h": {h}, "fit": {fit}, "fmt": {format}, "exp": {exp}}
+	return cfg.ProxyURL + photoID + "?" + q.Encode() + "&sig=" + hex.EncodeToString(m.Sum(nil))
+}
+
+type signedObject struct {
+	url     string
+	expires int64 // seconds since the epoch
+}
+
+// renditionURLs returns signed GET URLs for the objects, from memcache when we can.
+func renditionURLs(cx appengine.Context, bucket string, objects []string) map[string]signedObject {
+	urls := make(map[string]signedObject, len(objects))
+	if len(objects) == 0 {
+		return urls
+	}
+	keys := make([]string, len(objects))
+	for i, o := range objects {
+		keys[i] = "url:" + bucket + "/" + o
+	}
+	cached, err := memcache.GetMulti(cx, keys)
+	if err != nil {
+		cx.Errorf("renditionURLs GetMulti %v", err)
+	}
+
+	expiry := downloadExpiry()
+	var s *urlSigner
+	var fresh []*memcache.Item
+	for i, o := range objects {
+		if it, ok := cached[keys[i]]; ok {
+			if v := strings.SplitN(string(it.Value), "\n", 2); len(v) == 2 {
+				if exp, err := strconv.ParseInt(v[0], 10, 64); err == nil {
+					urls[o] = signedObject{v[1], exp}
+					continue
+				}
+			}
+		}
+		if s == nil {
+			s = appSigner(cx)
+		}
+		u, err := s.signedURL("GET", bucket, o, nil, expiry)
+		if err != nil {
+			cx.Errorf("renditionURLs sign %v %v", o, err)
+			continue
+		}
+		exp := s.now().Add(expiry).Unix()
+		urls[o] = signedObject{u, exp}
+		fresh = append(fresh, &memcache.Item{
+			Key:        keys[i],
+			Value:      []byte(strconv.FormatInt(exp, 10) + "\n" + u),
+			Expiration: expiry / 2,
+		})
+	}
+	if len(fresh) > 0 {
+		if err := memcache.SetMulti(cx, fresh); err != nil {
+			cx.Errorf("renditionURLs SetMulti %v", err)
+		}
+	}
+	return urls
+}
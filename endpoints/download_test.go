@@ -0,0 +1,60 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package abelana
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestProxyURL(t *testing.T) {
+	cfg := &AbelanaConfig{ProxyURL: "https://img.example.com/img/", ProxyKey: "k"}
+	// printf '1234.5678\n320\n320\nfill\nwebp\n1700000000' | openssl dgst -sha256 -hmac k
+	const want = "https://img.example.com/img/1234.5678?exp=1700000000&fit=fill&fmt=webp&h=320&w=320" +
+		"&sig=9aeb37033fa265c6afba30304044349ce7135ba995517cbb1acf6bbe1fec16bd"
+	if got := proxyURL(cfg, "1234.5678", "320", "320", "fill", "webp", "1700000000"); got != want {
+		t.Errorf("proxyURL\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestShortExpiry(t *testing.T) {
+	saved := config
+	config = &AbelanaConfig{DownloadExpirySeconds: 1, ProxyURL: "https://img.example.com/img/", ProxyKey: "k"}
+	defer func() { config = saved }()
+
+	if n := renewal(); n != 1 {
+		t.Errorf("renewal() = %d, want 1", n)
+	}
+	urlEpoch()
+	r, _ := http.NewRequest("GET", "/user/atok/timeline/0?size=320x320", nil)
+	sized := sizedURL(config, r)
+	if sized == nil {
+		t.Fatal("sizedURL returned nil")
+	}
+	u, err := url.Parse(sized("1234.5678"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, err := strconv.ParseInt(u.Query().Get("exp"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if now := time.Now().Unix(); exp <= now {
+		t.Errorf("exp %d isn't after now %d", exp, now)
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package abelana
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/GoogleCloudPlatform/abelana-gcp/third_party/redisx"
+)
+
+// Duplicates.  imagemagick sends the dHash of every photo, copies of a photo have hashes a few
+// bits apart.  We keep the hashes of the recent photos of each user in PH:userid, to point out
+// reposts, and the hashes of the photos moderation has hidden in BH:, so they can't come back.
+//
+// Hashes with very few bits set, or very few clear, are of flat images (a black frame, a white
+// page) that all look alike, they are never compared.
+//
+// BH: is indexed for Hamming distance lookups by splitting the hash in blockBands bands, each
+// hash is in the set BH:band:value of each of its bands.  Two hashes at most blockDistance bits
+// apart share at least one band, so looking at the sets of our bands finds them all.
+
+const (
+	recentHashes             = 100 // photos of a user we compare uploads with
+	blockBands               = 4
+	blockDistance            = blockBands - 1
+	defaultDuplicateDistance = 6
+
+	// minHashBits is how many bits must be set, and clear, for a hash to tell photos apart.
+	minHashBits = 8
+
+	// hiddenFlags is how many people must flag a photo to take it off the timelines, it waits
+	// there for moderation, see FLAGGED in server.go.
+	hiddenFlags = 2
+)
+
+// parsePHash reads the hex dHash imagemagick sends.
+func parsePHash(s string) (uint64, bool) {
+	h, err := strconv.ParseUint(s, 16, 64)
+	return h, err == nil && len(s) == 16
+}
+
+// informative reports whether h has enough bits set and clear to be compared.
+func informative(h uint64) bool {
+	n := hamming(h, 0)
+	return n >= minHashBits && n <= 64-minHashBits
+}
+
+// hamming returns the number of bits a and b differ in.
+func hamming(a, b uint64) int {
+	n := 0
+	for x := a ^ b; x != 0; x &= x - 1 {
+		n++
+	}
+	return n
+}
+
+func duplicateDistance() int {
+	if d := abelanaConfig().DuplicateDistance; d > 0 {
+		return d
+	}
+	return defaultDuplicateDistance
+}
+
+// findDuplicate returns the recent photo of the user that photoID, with hash h, is a copy of, if
+// any.
+func findDuplicate(conn redisx.Conn, userID, photoID string, h uint64) (string, error) {
+	if !informative(h) {
+		return "", nil
+	}
+	recent, err := redisx.Strings(conn.Do("LRANGE", "PH:"+userID, 0, -1))
+	if err != nil && err != redisx.ErrNil {
+		return "", err
+	}
+	best, bestDist := "", duplicateDistance()+1
+	for _, r := range recent {
+		f := strings.Fields(r) // photoid hash
+		if len(f) != 2 || f[0] == photoID {
+			continue // the photo itself when it's processed again
+		}
+		if o, ok := parsePHash(f[1]); ok && informative(o) {
+			if d := hamming(h, o); d < bestDist {
+				best, bestDist = f[0], d
+			}
+		}
+	}
+	return best, nil
+}
+
+// rememberHash adds the photo to the recent photos of the user.
+func rememberHash(conn redisx.Conn, userID, photoID string, h uint64) error {
+	conn.Send("LPUSH", "PH:"+userID, fmt.Sprintf("%s %016x", photoID, h))
+	conn.Send("LTRIM", "PH:"+userID, 0, recentHashes-1)
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Receive(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forgetHash takes the photo off the recent photos of the user.
+func forgetHash(conn redisx.Conn, userID, photoID string) error {
+	recent, err := redisx.Strings(conn.Do("LRANGE", "PH:"+userID, 0, -1))
+	if err != nil && err != redisx.ErrNil {
+		return err
+	}
+	for _, r := range recent {
+		if strings.HasPrefix(r, photoID+" ") {
+			if _, err := conn.Do("LREM", "PH:"+userID, 0, r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// bands returns the keys of the BH: sets of h.
+func bands(h uint64) []string {
+	keys := make([]string, blockBands)
+	bits := uint(64 / blockBands)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("BH:%d:%x", i, (h>>(uint(i)*bits))&(1<<bits-1))
+	}
+	return keys
+}
+
+// isBlocked reports whether h is a copy of a photo moderation has hidden.
+func isBlocked(conn redisx.Conn, h uint64) (bool, error) {
+	if !informative(h) {
+		return false, nil
+	}
+	for _, k := range bands(h) {
+		conn.Send("SMEMBERS", k)
+	}
+	if err := conn.Flush(); err != nil {
+		return false, err
+	}
+	blocked := false
+	for _ = range bands(h) {
+		members, err := redisx.Strings(conn.Receive())
+		if err != nil && err != redisx.ErrNil {
+			return false, err
+		}
+		for _, m := range members {
+			if b, ok := parsePHash(m); ok && hamming(h, b) <= blockDistance {
+				blocked = true
+			}
+		}
+	}
+	return blocked, nil
+}
+
+// blockPhoto keeps copies of a hidden photo from being posted again, called from delay when
+// moderation takes it down, see BlockPhoto.
+func blockPhoto(cx appengine.Context, photoID string) error {
+	s := strings.Split(photoID, ".")
+	var p Photo
+	k := datastore.NewKey(cx, "Photo", photoID, 0, datastore.NewKey(cx, "User", s[0], 0, nil))
+	if err := datastore.Get(cx, k, &p); err != nil {
+		cx.Errorf("blockPhoto: %v %v", photoID, err)
+		return nil // nothing to block, don't retry
+	}
+	h, ok := parsePHash(p.PHash)
+	if !ok {
+		return nil // photos from before we hashed them
+	}
+	if !informative(h) {
+		cx.Warningf("blockPhoto: %v %v is too plain to block its copies", photoID, p.PHash)
+		return nil
+	}
+
+	conn := pool.Get(cx)
+	defer conn.Close()
+	for _, k := range bands(h) {
+		conn.Send("SADD", k, p.PHash)
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("blockPhoto: %v %v", photoID, err)
+	}
+	for _ = range bands(h) {
+		if _, err := conn.Receive(); err != nil {
+			return fmt.Errorf("blockPhoto: %v %v", photoID, err)
+		}
+	}
+	cx.Infof("blockPhoto: %v %v", photoID, p.PHash)
+	return nil
+}
+
+// photoBlocked records that the upload won't be added, the uploader sees it as failed.
+func photoBlocked(cx appengine.Context, photoID string) error {
+	s := strings.Split(photoID, ".")
+	f := &PhotoFailure{photoID, "copy of a photo that was taken down", time.Now().UTC().Unix()}
+	k := datastore.NewKey(cx, "PhotoFailure", photoID, 0, datastore.NewKey(cx, "User", s[0], 0, nil))
+	if _, err := datastore.Put(cx, k, f); err != nil {
+		return fmt.Errorf("photoBlocked: %v %v", photoID, err)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package abelana
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/abelana-gcp/third_party/redisx"
+)
+
+// listConn answers for the PH: list of a user, the other commands are left to the nil Conn.
+type listConn struct {
+	redisx.Conn
+	list []string
+}
+
+func (c *listConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	switch cmd {
+	case "LRANGE":
+		v := make([]interface{}, len(c.list))
+		for i, s := range c.list {
+			v[i] = []byte(s)
+		}
+		return v, nil
+	case "LREM":
+		var kept []string
+		for _, s := range c.list {
+			if s != args[2] {
+				kept = append(kept, s)
+			}
+		}
+		c.list = kept
+		return int64(0), nil
+	}
+	return nil, fmt.Errorf("unexpected %s", cmd)
+}
+
+func TestInformative(t *testing.T) {
+	for _, tt := range []struct {
+		h    uint64
+		want bool
+	}{
+		{0, false},
+		{^uint64(0), false},
+		{0x00000000000000ff, true},
+		{0x000000000000007f, false},
+		{0xffffffffffffff00, true},
+		{0xffffffffffffff80, false},
+		{0x0f0f0f0f0f0f0f0f, true},
+	} {
+		if got := informative(tt.h); got != tt.want {
+			t.Errorf("informative(%016x) = %v, want %v", tt.h, got, tt.want)
+		}
+	}
+}
+
+func TestFindDuplicate(t *testing.T) {
+	const (
+		photo = 0x0f0f0f0f0f0f0f0f
+		flat  = 0x0000000000000003
+	)
+	conn := &listConn{list: []string{
+		fmt.Sprintf("u.self %016x", uint64(photo)),
+		fmt.Sprintf("u.flat %016x", uint64(flat)),
+		fmt.Sprintf("u.other %016x", uint64(0xf0f0f0f0f0f0f0f0)),
+		fmt.Sprintf("u.copy %016x", uint64(photo^0x0101)),
+		"garbage",
+	}}
+	for _, tt := range []struct {
+		photoID string
+		h       uint64
+		want    string
+	}{
+		{"u.new", photo, "u.self"},
+		{"u.self", photo, "u.copy"}, // processed again, it isn't a copy of itself
+		{"u.new", photo ^ 0x3f3f, ""},
+		{"u.new", flat ^ 1, ""}, // too plain to tell
+	} {
+		got, err := findDuplicate(conn, "u", tt.photoID, tt.h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("findDuplicate(%s, %016x) = %q, want %q", tt.photoID, tt.h, got, tt.want)
+		}
+	}
+}
+
+func TestForgetHash(t *testing.T) {
+	conn := &listConn{list: []string{"u.a 0f0f0f0f0f0f0f0f", "u.ab 0f0f0f0f0f0f0f0f", "u.a 00000000000000ff"}}
+	if err := forgetHash(conn, "u", "u.a"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"u.ab 0f0f0f0f0f0f0f0f"}; !reflect.DeepEqual(conn.list, want) {
+		t.Errorf("PH: is %v, want %v", conn.list, want)
+	}
+}
+
+func TestBands(t *testing.T) {
+	// Hashes blockDistance bits apart always share a band.
+	a := uint64(0x0123456789abcdef)
+	b := a ^ (1 | 1<<16 | 1<<32)
+	shared := false
+	for i, k := range bands(a) {
+		if bands(b)[i] == k {
+			shared = true
+		}
+		if !strings.HasPrefix(k, fmt.Sprintf("BH:%d:", i)) {
+			t.Errorf("band %d is %q", i, k)
+		}
+	}
+	if !shared {
+		t.Errorf("%016x and %016x share no band", a, b)
+	}
+}
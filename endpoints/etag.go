@@ -0,0 +1,95 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package abelana
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"appengine"
+)
+
+// Conditional GETs.  Where we keep a version counter in Redis (see VR: in server.go) the ETag is
+// built from it, and a matching If-None-Match is answered before we touch Datastore.  Everything
+// else gets an ETag that is a hash of the reply, which still saves the client the download.
+
+// versionETag returns the ETag for version v of a resource, or "" if we don't know the version.
+// The API version is part of the tag as v1 and v2 replies differ for the same data.
+func versionETag(w http.ResponseWriter, v int64, parts ...string) string {
+	if v <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(`"%s-%d-%s"`, replyVersion(w), v, strings.Join(parts, "-"))
+}
+
+// acceptTag returns a short hash of the Accept header, for the ETags of replies that depend on
+// the formats it negotiates.
+func acceptTag(r *http.Request) string {
+	sum := sha1.Sum([]byte(r.Header.Get("Accept")))
+	return hex.EncodeToString(sum[:6])
+}
+
+// notModified sets the ETag header and, if the client already has that version, replies with
+// 304.  It reports whether the reply has been sent.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	w.Header().Set("ETag", etag)
+	for _, t := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if t = strings.TrimSpace(t); t == etag || t == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// replyVersioned replies with v, tagged with etag if the resource is versioned and with a hash of
+// the reply if not.
+func replyVersioned(w http.ResponseWriter, r *http.Request, etag string, v interface{}) {
+	if etag != "" {
+		replyJSON(w, v)
+		return
+	}
+	b, err := json.Marshal(transformReply(w, v))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sum := sha1.Sum(b)
+	if notModified(w, r, `"`+base64.URLEncoding.EncodeToString(sum[:])+`"`) {
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	if _, err = w.Write(b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// resourceVersion reads a version counter, errors just mean we can't do cheap ETags.
+func resourceVersion(cx appengine.Context, id, field string) int64 {
+	v, err := getVersion(cx, id, field)
+	if err != nil {
+		cx.Errorf("resourceVersion %v %v %v", id, field, err)
+		return 0
+	}
+	return v
+}
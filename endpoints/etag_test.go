@@ -0,0 +1,36 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package abelana
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAcceptTag(t *testing.T) {
+	tag := func(accept string) string {
+		r, _ := http.NewRequest("GET", "/", nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		return acceptTag(r)
+	}
+	if tag("image/webp") == tag("image/jpeg") || tag("") == tag("image/webp") {
+		t.Error("replies to different Accept headers share an ETag")
+	}
+	if tag("image/webp") != tag("image/webp") {
+		t.Error("acceptTag isn't stable")
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package abelana
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Renditions are written in several formats, imagemagick tells us which with the extensions of
+// each suffix.  We keep them as "a=webp,jpeg;b=webp", in Photo and in the IMM: hash.
+
+// encodeFormats returns formats in the form we keep them.
+func encodeFormats(formats map[string][]string) string {
+	suffixes := make([]string, 0, len(formats))
+	for s := range formats {
+		suffixes = append(suffixes, s)
+	}
+	sort.Strings(suffixes)
+	parts := make([]string, len(suffixes))
+	for i, s := range suffixes {
+		parts[i] = s + "=" + strings.Join(formats[s], ",")
+	}
+	return strings.Join(parts, ";")
+}
+
+// parseFormats undoes encodeFormats, photos from before we kept formats have none.
+func parseFormats(s string) map[string][]string {
+	if s == "" {
+		return nil
+	}
+	formats := make(map[string][]string)
+	for _, part := range strings.Split(s, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 && kv[1] != "" {
+			formats[kv[0]] = strings.Split(kv[1], ",")
+		}
+	}
+	return formats
+}
+
+// negotiate picks the extension in exts the Accept header prefers.  Ties, and clients that don't
+// say, get the earliest one, imagemagick lists them in the order of the config.
+func negotiate(accept string, exts []string) string {
+	if len(exts) == 0 {
+		return ""
+	}
+	if strings.TrimSpace(accept) == "" {
+		return exts[0]
+	}
+	best, bestQ := exts[0], 0.0
+	for _, ext := range exts {
+		if q := acceptQ(accept, "image/"+ext); q > bestQ {
+			best, bestQ = ext, q
+		}
+	}
+	return best
+}
+
+// acceptQ returns the quality the Accept header gives to the content type, the most specific
+// range that matches wins.
+func acceptQ(accept, ctype string) float64 {
+	q, specificity := 0.0, -1
+	for _, r := range strings.Split(accept, ",") {
+		params := strings.Split(r, ";")
+		mr := strings.ToLower(strings.TrimSpace(params[0]))
+		s := -1
+		switch {
+		case mr == ctype:
+			s = 2
+		case mr == ctype[:strings.Index(ctype, "/")+1]+"*":
+			s = 1
+		case mr == "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+		rq := 1.0
+		for _, p := range params[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(p), "=", 2); len(kv) == 2 && kv[0] == "q" {
+				if f, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					rq = f
+				}
+			}
+		}
+		q, specificity = rq, s
+	}
+	return q
+}
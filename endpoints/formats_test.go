@@ -0,0 +1,87 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package abelana
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFormats(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want map[string][]string
+	}{
+		{"", nil},
+		{"a=webp", map[string][]string{"a": {"webp"}}},
+		{"a=webp,jpeg;b=webp", map[string][]string{"a": {"webp", "jpeg"}, "b": {"webp"}}},
+		{"a=;b=jpeg;c", map[string][]string{"b": {"jpeg"}}}, // the broken parts are dropped
+	} {
+		got := parseFormats(tt.in)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseFormats(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+		if tt.want != nil {
+			if s := encodeFormats(got); parseFormats(s) == nil || !reflect.DeepEqual(parseFormats(s), got) {
+				t.Errorf("encodeFormats(%v) = %q doesn't parse back", got, s)
+			}
+		}
+	}
+	if s := encodeFormats(map[string][]string{"b": {"webp"}, "a": {"webp", "jpeg"}}); s != "a=webp,jpeg;b=webp" {
+		t.Errorf("encodeFormats = %q, want the suffixes sorted", s)
+	}
+}
+
+func TestAcceptQ(t *testing.T) {
+	for _, tt := range []struct {
+		accept, ctype string
+		want          float64
+	}{
+		{"image/webp", "image/webp", 1},
+		{"image/webp", "image/jpeg", 0},
+		{"image/*;q=0.8", "image/jpeg", 0.8},
+		{"*/*;q=0.1", "image/avif", 0.1},
+		{"image/webp;q=0.9, image/*;q=0.5, */*;q=0.1", "image/webp", 0.9},
+		{"image/webp;q=0.9, image/*;q=0.5, */*;q=0.1", "image/jpeg", 0.5},
+		{"image/*, image/webp;q=0", "image/webp", 0}, // the specific range wins
+		{"IMAGE/WEBP", "image/webp", 1},
+		{"image/webp; q=bad", "image/webp", 1},
+		{"text/html", "image/webp", 0},
+	} {
+		if got := acceptQ(tt.accept, tt.ctype); got != tt.want {
+			t.Errorf("acceptQ(%q, %q) = %v, want %v", tt.accept, tt.ctype, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	exts := []string{"avif", "webp", "jpeg"}
+	for _, tt := range []struct {
+		accept string
+		exts   []string
+		want   string
+	}{
+		{"", exts, "avif"},
+		{"image/webp,image/*;q=0.8", exts, "webp"},
+		{"image/avif,image/webp,*/*;q=0.8", exts, "avif"}, // a tie goes to the first
+		{"image/jpeg", exts, "jpeg"},
+		{"image/png", exts, "avif"}, // nothing acceptable, we still send something
+		{"image/webp", nil, ""},
+	} {
+		if got := negotiate(tt.accept, tt.exts); got != tt.want {
+			t.Errorf("negotiate(%q, %v) = %q, want %q", tt.accept, tt.exts, got, tt.want)
+		}
+	}
+}
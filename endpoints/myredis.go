@@ -116,17 +116,59 @@ func initialPhotos(cx appengine.Context, ID string) error {
 	return nil // don't retry this.
 }
 
+// addPhotoWithoutInfo is addPhoto as it was queued before imagemagick told us about the photo, the
+// tasks queued by the previous version still run under its name.
+func addPhotoWithoutInfo(cx appengine.Context, photoID string) error {
+	return addPhoto(cx, photoID, PhotoInfo{})
+}
+
 // addPhoto is called to add a photo. This is allways called from a Delay
-func addPhoto(cx appengine.Context, photoID string) error {
+func addPhoto(cx appengine.Context, photoID string, info PhotoInfo) error {
 	var u *User
 	var err error
 
 	s := strings.Split(photoID, ".")
+	if info.Trace != "" {
+		cx.Infof("addPhoto: trace %v %v", info.Trace, photoID)
+	}
 
 	// s[0] = userid, s[1] = random photo id
 	userID := s[0]
-	p := &Photo{photoID, time.Now().UTC().Unix()}
+	p := &Photo{
+		PhotoID:     photoID,
+		Date:        time.Now().UTC().Unix(),
+		Taken:       info.Taken,
+		CameraMake:  info.Make,
+		CameraModel: info.Model,
+		Formats:     encodeFormats(info.Formats),
+		Color:       info.Color,
+		BlurHash:    info.BlurHash,
+		PHash:       info.PHash,
+		Animated:    info.Animated,
+	}
+
+	conn := pool.Get(cx)
+	defer conn.Close()
+
+	h, hashed := parsePHash(info.PHash)
 	if userID != "0001" {
+		if hashed {
+			blocked, err := isBlocked(conn, h)
+			if err != nil {
+				cx.Errorf("addPhoto: blocked %v %v", photoID, err)
+			}
+			if blocked {
+				cx.Warningf("addPhoto: %v is a copy of a hidden photo", photoID)
+				return photoBlocked(cx, photoID)
+			}
+			if p.DuplicateOf, err = findDuplicate(conn, userID, photoID, h); err != nil {
+				cx.Errorf("addPhoto: duplicates %v %v", photoID, err)
+			}
+			if p.DuplicateOf != "" {
+				cx.Infof("addPhoto: %v looks like %v", photoID, p.DuplicateOf)
+			}
+		}
+
 		u, err = findUser(cx, userID)
 		if err != nil {
 			return fmt.Errorf("addPhoto: unable to find user %v %v", userID, err)
@@ -138,17 +180,27 @@ func addPhoto(cx appengine.Context, photoID string) error {
 		}
 	}
 
-	conn := pool.Get(cx)
-	defer conn.Close()
-
 	set, err := redisx.Int(conn.Do("HSETNX", "IM:"+photoID, "date", p.Date)) // Set Date
 	if (err != nil && err != redisx.ErrNil) || set == 0 {
 		cx.Infof("addPhoto: duplicate %v %v", err, set)
 		return nil // returning the error here makes TaskQ call us a lot.
 	}
+	if meta := photoMeta(p); len(meta) > 0 {
+		if _, err := conn.Do("HMSET", append([]interface{}{"IMM:" + photoID}, meta...)...); err != nil {
+			cx.Errorf("addPhoto: HMSET IMM:%v %v", photoID, err)
+		}
+	}
 	// TODO: Consider if these should be done in batches of 100 or so.
 
 	if userID != "0001" {
+		if hashed {
+			if err := rememberHash(conn, userID, photoID, h); err != nil {
+				cx.Errorf("addPhoto: PH:%v %v", userID, err)
+			}
+		}
+		if _, err := conn.Do("HINCRBY", "VR:"+userID, "pr", 1); err != nil {
+			cx.Errorf("addPhoto: bump VR:%v %v", userID, err)
+		}
 		list := append(u.FollowsMe, userID) // Make sure I can see the photo...
 		// Add to each follower's list
 		for _, f := range list {
@@ -173,6 +225,83 @@ func addPhoto(cx appengine.Context, photoID string) error {
 	return nil
 }
 
+// photoMeta returns the fields of the IMM: hash, as HMSET arguments.  getTimeline reads them back
+// in this order.
+func photoMeta(p *Photo) []interface{} {
+	var meta []interface{}
+	anim := ""
+	if p.Animated {
+		anim = "1"
+	}
+	for _, f := range []struct{ name, value string }{
+		{"fmt", p.Formats},
+		{"color", p.Color},
+		{"bh", p.BlurHash},
+		{"anim", anim},
+	} {
+		if f.value != "" {
+			meta = append(meta, f.name, f.value)
+		}
+	}
+	return meta
+}
+
+// retirePhoto undoes addPhoto, the photo, its likes and comments are gone.
+func retirePhoto(cx appengine.Context, photoID string) error {
+	s := strings.Split(photoID, ".")
+	userID := s[0]
+	list := []string{userID}
+
+	if userID != "0001" {
+		u, err := findUser(cx, userID)
+		if err != nil {
+			return fmt.Errorf("retirePhoto: unable to find user %v %v", userID, err)
+		}
+		list = append(list, u.FollowsMe...)
+
+		k := datastore.NewKey(cx, "Photo", photoID, 0,
+			datastore.NewKey(cx, "User", userID, 0, nil))
+		keys, err := datastore.NewQuery("").Ancestor(k).KeysOnly().GetAll(cx, nil)
+		if err != nil {
+			return fmt.Errorf("retirePhoto: find %v %v", photoID, err)
+		}
+		if err := datastore.DeleteMulti(cx, keys); err != nil {
+			return fmt.Errorf("retirePhoto: delete %v %v", photoID, err)
+		}
+		// The uploader may still be polling the status, it has to learn the photo is gone.
+		if err := setPhotoState(cx, photoID, photoDeleted, nil, nil); err != nil {
+			return fmt.Errorf("retirePhoto: state of %v %v", photoID, err)
+		}
+	}
+
+	conn := pool.Get(cx)
+	defer conn.Close()
+
+	for _, f := range list {
+		conn.Send("LREM", "TL:"+f, 0, photoID)
+	}
+	conn.Send("DEL", "IM:"+photoID, "IMM:"+photoID, "FL:"+photoID, "VR:"+photoID)
+	conn.Send("ZREM", "FLAGGED", photoID)
+	conn.Send("HINCRBY", "VR:"+userID, "pr", 1)
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("retirePhoto: %v", err)
+	}
+	for _ = range list {
+		if _, err := conn.Receive(); err != nil {
+			cx.Errorf("retirePhoto: LREM %v %v", photoID, err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := conn.Receive(); err != nil {
+			cx.Errorf("retirePhoto: %v %v", photoID, err)
+		}
+	}
+	if err := forgetHash(conn, userID, photoID); err != nil {
+		cx.Errorf("retirePhoto: PH:%v %v", userID, err)
+	}
+	return nil
+}
+
 // getTimeline returns the user's Timeline, you could insert additional things here as well.
 func getTimeline(cx appengine.Context, userID, lastid string) ([]TLEntry, error) {
 	conn := pool.Get(cx)
@@ -204,7 +333,7 @@ func getTimeline(cx appengine.Context, userID, lastid string) ([]TLEntry, error)
 		}
 		if len(v) > 2 && v[2] != "" {
 			flags, err := strconv.Atoi(v[2])
-			if err == nil && flags > 1 {
+			if err == nil && flags >= hiddenFlags {
 				continue // skip flag'd images
 			}
 		}
@@ -215,6 +344,10 @@ func getTimeline(cx appengine.Context, userID, lastid string) ([]TLEntry, error)
 		} else {
 			likes = likes - 1 // offset as there is a Date as well
 		}
+		meta, err := redisx.Strings(conn.Do("HMGET", "IMM:"+photoID, "fmt", "color", "bh", "anim"))
+		if err != nil && err != redisx.ErrNil {
+			cx.Errorf("GetTimeLine HMGET IMM: %v", err)
+		}
 		s := strings.Split(photoID, ".")
 		dn, err := redisx.String(conn.Do("HGET", "HT:"+s[0], "dn"))
 		if err != nil && err != redisx.ErrNil {
@@ -225,7 +358,11 @@ func getTimeline(cx appengine.Context, userID, lastid string) ([]TLEntry, error)
 		if err != nil {
 			dt = 1414883602 // Nov 1, 2014
 		}
-		te := TLEntry{dt, s[0], dn, photoID, likes, v[1] == "1"}
+		te := TLEntry{Created: dt, UserID: s[0], Name: dn, PhotoID: photoID, Likes: likes, ILike: v[1] == "1"}
+		if len(meta) == 4 {
+			te.Formats, te.Color, te.BlurHash = parseFormats(meta[0]), meta[1], meta[2]
+			te.Animated = meta[3] == "1"
+		}
 		timeline = append(timeline, te)
 	}
 	return timeline, nil
@@ -294,14 +431,91 @@ func unlike(cx appengine.Context, userID, photoID string) error {
 	return nil
 }
 
-// flag will tell us that things may not be quite right with this image.
-func flag(cx appengine.Context, userID, photoID string) error {
+// flag will tell us that things may not be quite right with this image, it returns how many
+// people have flagged it.  Flagging it again changes nothing.
+func flag(cx appengine.Context, userID, photoID string) (int, error) {
 	conn := pool.Get(cx)
 	defer conn.Close()
 
-	_, err := redisx.Int(conn.Do("HINCRBY", "IM:"+photoID, "flag", 1))
+	added, err := redisx.Int(conn.Do("SADD", "FL:"+photoID, userID))
+	if err != nil {
+		return 0, fmt.Errorf("flag %v", err)
+	}
+	if added == 0 {
+		return redisx.Int(conn.Do("SCARD", "FL:"+photoID))
+	}
+	n, err := redisx.Int(conn.Do("HINCRBY", "IM:"+photoID, "flag", 1))
 	if err != nil && err != redisx.ErrNil {
-		return fmt.Errorf("unlike %v", err)
+		return 0, fmt.Errorf("flag %v", err)
+	}
+	if _, err := conn.Do("ZADD", "FLAGGED", n, photoID); err != nil {
+		return n, fmt.Errorf("flag FLAGGED %v", err)
+	}
+	return n, nil
+}
+
+// flagged returns the most flagged photos and how many people flagged each.
+func flagged(cx appengine.Context, max int) ([]FlaggedPhoto, error) {
+	conn := pool.Get(cx)
+	defer conn.Close()
+
+	v, err := redisx.Strings(conn.Do("ZREVRANGE", "FLAGGED", 0, max-1, "WITHSCORES"))
+	if err != nil && err != redisx.ErrNil {
+		return nil, fmt.Errorf("flagged %v", err)
+	}
+	var fl []FlaggedPhoto
+	for i := 0; i+1 < len(v); i += 2 {
+		n, _ := strconv.Atoi(v[i+1])
+		fl = append(fl, FlaggedPhoto{PhotoID: v[i], Flags: n})
+	}
+	return fl, nil
+}
+
+// dismissFlags forgets who flagged the photo, it's back on the timelines.
+func dismissFlags(cx appengine.Context, photoID string) error {
+	conn := pool.Get(cx)
+	defer conn.Close()
+
+	conn.Send("HDEL", "IM:"+photoID, "flag")
+	conn.Send("DEL", "FL:"+photoID)
+	conn.Send("ZREM", "FLAGGED", photoID)
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := conn.Receive(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
+
+// unflag takes the photo off the moderation queue.
+func unflag(cx appengine.Context, photoID string) error {
+	conn := pool.Get(cx)
+	defer conn.Close()
+
+	_, err := conn.Do("ZREM", "FLAGGED", photoID)
+	return err
+}
+
+// bumpVersion increments a version counter, see VR: in server.go
+func bumpVersion(cx appengine.Context, id, field string) error {
+	conn := pool.Get(cx)
+	defer conn.Close()
+
+	_, err := conn.Do("HINCRBY", "VR:"+id, field, 1)
+	return err
+}
+
+// getVersion returns a version counter, 0 if we've never bumped it.
+func getVersion(cx appengine.Context, id, field string) (int64, error) {
+	conn := pool.Get(cx)
+	defer conn.Close()
+
+	v, err := redisx.Int64(conn.Do("HGET", "VR:"+id, field))
+	if err == redisx.ErrNil {
+		return 0, nil
+	}
+	return v, err
+}
@@ -16,6 +16,7 @@ package abelana
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -37,27 +38,55 @@ import (
 // IM:uuuuuu.ppppppp HASH an imageID
 //   date  is the date the photo was added
 //   flag  DON'T SHOW THIS TO OTHERS 'TIL REVIEW -- must get +2
+//         (the number of people in FL:)
 //   uuuuuu is the id of a user that likes the photo
 //   (Total count of likes is (HLEN k) -2)
 //
+// IMM:uuuuuu.ppppppp HASH what we know about the image, see photoMeta
+//   fmt   the formats of the renditions, see encodeFormats
+//   color the dominant colour, bh the BlurHash placeholder
+//   anim  1 if the renditions that can animate do
+//
+// FL:uuuuuu.ppppppp SET the ids of the users that flagged the image
+// FLAGGED ZSET the flagged images by number of flags, what moderation has to look at
+//
 // TL:uuuuuu LIST The timeline[max 2000] for each user. (list of photos)
 // HT:uuuuuu HASH
 //   dn is the displayName for the user.
+//
+// VR:uuuuuu HASH version counters, used for ETags
+//   pr  bumped when the user's profile (their photos) changes
+//   fl  bumped when the list of people the user follows changes
+// VR:uuuuuu.ppppppp HASH version counters for a photo
+//   cm  bumped when a comment is added
 
 // In datastore we have the following:
 // User >> Photo >> Like
 //               >> Comments
+//      >> PhotoFailure
+//      >> PhotoState
 
 var DEBUG = true
 
+// traceHeader carries the id notice gave the upload, imagemagick passes it on to photopush.
+const traceHeader = "X-Trace-Id"
+
+// api is the router for everything we serve, batches dispatch their sub requests through it.
+var api http.Handler
+
 var (
 	delayCopyUserPhoto = delay.Func("copyUserPhoto", copyUserPhoto)
-	delayAddPhoto      = delay.Func("addPhoto", addPhoto)
+	delayAddPhoto      = delay.Func("addPhoto", addPhotoWithoutInfo)
+	delayAddPhotoInfo  = delay.Func("addPhotoInfo", addPhoto)
+	delayRetirePhoto   = delay.Func("retirePhoto", retirePhoto)
 	delayINowFollow    = delay.Func("iNowFollow", iNowFollow)
 	delayFindFollows   = delay.Func("findFollows", findFollows)
 	delayInitialPhotos = delay.Func("initialPhotos", initialPhotos)
 	delayFollowById    = delay.Func("followById", followById)
 	delayInitialSetup  = delay.Func("initialSetup", initialSetup)
+	delayBlockPhoto    = delay.Func("blockPhoto", blockPhoto)
+
+	delayApproveFollowers = delay.Func("approveFollowers", approveFollowers)
 )
 
 type (
@@ -69,14 +98,63 @@ type (
 		FollowsMe     []string // list of userID's
 		IFollow       []string
 		IWantToFollow []string // list of email addresses
+		Private       bool     // only followers see the photos
+		FollowersAsk  []string // userIDs waiting for a private account to approve them
+		NoWatermark   bool     // shared renditions go without the watermark
 	}
 
 	// Photo is how we keep images in Datastore
 	Photo struct {
+		PhotoID     string
+		Date        int64
+		Taken       int64 // capture time from EXIF, 0 if unknown
+		CameraMake  string
+		CameraModel string
+		Formats     string `datastore:",noindex"` // see encodeFormats
+		Color       string `datastore:",noindex"` // dominant colour, #rrggbb
+		BlurHash    string `datastore:",noindex"` // placeholder while the renditions load
+		PHash       string `datastore:",noindex"` // dHash, see duplicates.go
+		DuplicateOf string // a recent photo of the same user this one is a copy of
+		Animated    bool   `datastore:",noindex"` // the renditions that can animate do
+	}
+
+	// FlaggedPhoto is a photo waiting for moderation.
+	FlaggedPhoto struct {
+		PhotoID string `json:"photoid"`
+		Flags   int    `json:"flags"`
+	}
+
+	// Flagged is the moderation queue.
+	Flagged struct {
+		Kind   string         `json:"kind"`
+		Photos []FlaggedPhoto `json:"photos"`
+	}
+
+	// PhotoFailure records why imagemagick couldn't process a photo.
+	PhotoFailure struct {
 		PhotoID string
+		Reason  string
 		Date    int64
 	}
 
+	// PhotoInfo is what imagemagick tells us about a photo it has processed, it is the body of
+	// the photopush call.  Only metadata that is safe to share makes it this far.
+	PhotoInfo struct {
+		Taken int64  `json:"taken,omitempty"`
+		Make  string `json:"make,omitempty"`
+		Model string `json:"model,omitempty"`
+
+		Color    string `json:"color,omitempty"`
+		BlurHash string `json:"blurhash,omitempty"`
+		PHash    string `json:"phash,omitempty"`
+		Animated bool   `json:"animated,omitempty"`
+
+		Renditions []string            `json:"renditions,omitempty"` // suffixes of the renditions written
+		Formats    map[string][]string `json:"formats,omitempty"`    // their extensions, by suffix
+
+		Trace string `json:"-"` // from traceHeader, so the delayed addPhoto can log it
+	}
+
 	// ToLike knows about who likes you.
 	ToLike struct {
 		UserID string
@@ -102,6 +180,15 @@ type (
 		PhotoID string `json:"photoid"`
 		Likes   int    `json:"likes"`
 		ILike   bool   `json:"ilike"`
+
+		Color    string `json:"color,omitempty"`    // placeholders the client can paint at once
+		BlurHash string `json:"blurhash,omitempty"` // while the rendition downloads
+		Animated bool   `json:"animated,omitempty"` // the WebP renditions animate, the others are a still
+
+		Formats map[string][]string `json:"formats,omitempty"` // extensions of the renditions, by suffix
+		URLs    map[string]string   `json:"urls,omitempty"`    // signed URLs of the renditions, by suffix
+		Sized   string              `json:"sized,omitempty"`   // signed URL of the size asked for with ?size=
+		Expires int64               `json:"expires,omitempty"` // when the first of the URLs expires
 	}
 
 	// Timeline the data the client sees.
@@ -147,45 +234,122 @@ type (
 func init() {
 	m := martini.Classic()
 	m.Use(func(c martini.Context, r *http.Request) {
-		c.MapTo(appengine.NewContext(r), (*appengine.Context)(nil))
+		c.MapTo(requestContext(r), (*appengine.Context)(nil))
 	})
 
-	m.Get("/user/:gittok/login/:displayName/:photoUrl", Login)                  // => ATOKJson
-	m.Get("/user/:atok/refresh", Aauth, Refresh)                                // => ATOKJson
-	m.Get("/user/:atok/useful", Aauth, GetSecretKey)                            // => Status
-	m.Delete("/user/:atok", Aauth, Wipeout)                                     // => Status
-	m.Post("/user/:atok/following/facebook/:fbkey", Aauth, Import)              // => Status
-	m.Post("/user/:atok/following/plus/:plkey", Aauth, Import)                  // => Status
-	m.Post("/user/:atok/following/yahoo/:ykey", Aauth, Import)                  // => Status
-	m.Get("/user/:atok/following", Aauth, GetFollowing)                         // => Persons
-	m.Put("/user/:atok/following/:personid", Aauth, FollowByID)                 // => Status
-	m.Get("/user/:atok/following/:personid", Aauth, GetPerson)                  // => Person
-	m.Put("/user/:atok/follow/:email", Aauth, Follow)                           // => Status
-	m.Put("/user/:atok/device/:regid", Aauth, Register)                         // => Status
-	m.Get("/user/:atok/stats", Aauth, Statistics)                               // => Stats
-	m.Delete("/user/:atok/device/:regid", Aauth, Unregister)                    // => Status
-	m.Get("/user/:atok/timeline/:lastid", Aauth, GetTimeLine)                   // => Timeline
-	m.Get("/user/:atok/profile/:lastdate", Aauth, GetMyProfile)                 // => Timeline
-	m.Get("/user/:atok/following/:personid/profile/:lastdate", Aauth, FProfile) // => Timeline
-
-	m.Post("/photo/:atok/:photoid/comment/:text", Aauth, SetPhotoComments) // => Status
-	m.Get("/photo/:atok/:photoid/comments", Aauth, GetPhotoComments)       // => Comments
-	m.Put("/photo/:atok/:photoid/like", Aauth, Like)                       // => Status
-	m.Delete("/photo/:atok/:photoid/like", Aauth, Unlike)                  // => Status
-	m.Get("/photo/:atok/:photoid/flag", Aauth, Flag)                       // => Status
-
-	m.Post("/photopush/:superid", PostPhoto) // "ok"
-
-	if abelanaConfig().EnableBackdoor {
-		m.Get("/user/:gittok/login", Login)
-	}
+	// The unversioned paths are what the shipped Android client uses, they are v1.
+	m.Group("", routes(apiV1), apiVersion(apiV1))
+	m.Group("/"+apiV1, routes(apiV1), apiVersion(apiV1))
+	m.Group("/"+apiV2, routes(apiV2), apiVersion(apiV2))
+
+	m.Post("/photopush/:superid", PostPhoto)                      // "ok"
+	m.Post("/photopush/:superid/processing", PostPhotoProcessing) // "ok"
+	m.Post("/photopush/:superid/failed", PostPhotoFailed)         // "ok"
+	m.Post("/photopush/:superid/deleted", PostPhotoDeleted)       // "ok"
+	m.Get("/photopush/:superid/attribution", GetAttribution)      // => Attribution
 
+	m.Get("/admin/flagged", GetFlagged)                   // => Flagged
+	m.Post("/admin/photo/:photoid/block", BlockPhoto)     // "ok"
+	m.Delete("/admin/photo/:photoid/flags", DismissFlags) // "ok"
+
+	api = m
 	http.Handle("/", m)
 }
 
+// apiRoute is a route of the API, in every version from since up to and including until, an
+// empty until for the versions still to come.
+type apiRoute struct {
+	since, until string
+	method, path string
+	handlers     []martini.Handler
+}
+
+// apiRoutes is the API of every version.  The v1 routes are FROZEN: a route leaving the API gets
+// an until instead of being removed, new work starts at the current version.
+var apiRoutes = []apiRoute{
+	{apiV1, "", "GET", "/user/:gittok/login/:displayName/:photoUrl", chain(Login)},                  // => ATOKJson
+	{apiV1, "", "GET", "/user/:atok/refresh", chain(Aauth, Refresh)},                                // => ATOKJson
+	{apiV1, apiV1, "GET", "/user/:atok/useful", chain(Aauth, GetSecretKey)},                         // => Status
+	{apiV1, "", "DELETE", "/user/:atok", chain(Aauth, Wipeout)},                                     // => Status
+	{apiV1, "", "POST", "/user/:atok/following/facebook/:fbkey", chain(Aauth, Import)},              // => Status
+	{apiV1, "", "POST", "/user/:atok/following/plus/:plkey", chain(Aauth, Import)},                  // => Status
+	{apiV1, "", "POST", "/user/:atok/following/yahoo/:ykey", chain(Aauth, Import)},                  // => Status
+	{apiV1, "", "GET", "/user/:atok/following", chain(Aauth, GetFollowing)},                         // => Persons
+	{apiV1, "", "PUT", "/user/:atok/following/:personid", chain(Aauth, FollowByID)},                 // => Status
+	{apiV1, "", "GET", "/user/:atok/following/:personid", chain(Aauth, GetPerson)},                  // => Person
+	{apiV1, "", "PUT", "/user/:atok/follow/:email", chain(Aauth, Follow)},                           // => Status
+	{apiV1, "", "PUT", "/user/:atok/device/:regid", chain(Aauth, Register)},                         // => Status
+	{apiV1, "", "GET", "/user/:atok/stats", chain(Aauth, Statistics)},                               // => Stats
+	{apiV1, "", "DELETE", "/user/:atok/device/:regid", chain(Aauth, Unregister)},                    // => Status
+	{apiV1, "", "GET", "/user/:atok/timeline/:lastid", chain(Aauth, GetTimeLine)},                   // => Timeline
+	{apiV1, "", "GET", "/user/:atok/profile/:lastdate", chain(Aauth, GetMyProfile)},                 // => Timeline
+	{apiV1, "", "GET", "/user/:atok/following/:personid/profile/:lastdate", chain(Aauth, FProfile)}, // => Timeline
+	{apiV2, "", "PUT", "/user/:atok/visibility/:visibility", chain(Aauth, SetVisibility)},           // => Status
+	{apiV2, "", "PUT", "/user/:atok/watermark/:onoff", chain(Aauth, SetWatermark)},                  // => Status
+	{apiV2, "", "GET", "/user/:atok/requests", chain(Aauth, GetFollowRequests)},                     // => Persons
+	{apiV2, "", "PUT", "/user/:atok/requests/:personid", chain(Aauth, ApproveFollower)},             // => Status
+	{apiV2, "", "DELETE", "/user/:atok/requests/:personid", chain(Aauth, DenyFollower)},             // => Status
+
+	{apiV1, "", "POST", "/photo/:atok/:photoid/comment/:text", chain(Aauth, SetPhotoComments)}, // => Status
+	{apiV1, "", "GET", "/photo/:atok/:photoid/comments", chain(Aauth, GetPhotoComments)},       // => Comments
+	{apiV1, "", "PUT", "/photo/:atok/:photoid/like", chain(Aauth, Like)},                       // => Status
+	{apiV1, "", "DELETE", "/photo/:atok/:photoid/like", chain(Aauth, Unlike)},                  // => Status
+	{apiV1, "", "GET", "/photo/:atok/:photoid/flag", chain(Aauth, Flag)},                       // => Status
+	{apiV2, "", "GET", "/photo/:atok/:photoid/status", chain(Aauth, GetPhotoStatus)},           // => PhotoStatus
+	{apiV2, "", "POST", "/photo/:atok/upload", chain(Aauth, PostUpload)},                       // => UploadURL
+
+	{apiV2, "", "POST", "/batch/:atok", chain(Aauth, PostBatch)}, // => Batch
+}
+
+// chain lists the handlers of a route.
+func chain(handlers ...martini.Handler) []martini.Handler {
+	return handlers
+}
+
+// apiVersions are the versions of the API, oldest first.
+var apiVersions = []string{apiV1, apiV2}
+
+// versionIndex returns the position of version in apiVersions.
+func versionIndex(version string) int {
+	for i, v := range apiVersions {
+		if v == version {
+			return i
+		}
+	}
+	panic("unknown API version " + version)
+}
+
+// routes returns what mounts the API as it is in version.
+func routes(version string) func(martini.Router) {
+	return func(r martini.Router) {
+		v := versionIndex(version)
+		for _, rt := range apiRoutes {
+			if v < versionIndex(rt.since) || (rt.until != "" && v > versionIndex(rt.until)) {
+				continue
+			}
+			switch rt.method {
+			case "GET":
+				r.Get(rt.path, rt.handlers...)
+			case "POST":
+				r.Post(rt.path, rt.handlers...)
+			case "PUT":
+				r.Put(rt.path, rt.handlers...)
+			case "DELETE":
+				r.Delete(rt.path, rt.handlers...)
+			default:
+				panic("unknown method " + rt.method)
+			}
+		}
+
+		if abelanaConfig().EnableBackdoor {
+			r.Get("/user/:gittok/login", Login)
+		}
+	}
+}
+
 // replyJSON Given an object, convert to JSON and reply with it
 func replyJSON(w http.ResponseWriter, v interface{}) {
-	b, err := json.Marshal(v)
+	b, err := json.Marshal(transformReply(w, v))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -207,34 +371,72 @@ func replyOk(w http.ResponseWriter) {
 // Timeline
 ///////////////////////////////////////////////////////////////////////////////////////////////////
 
-// GetTimeLine - get the timeline for the user (token) : TlResp
-func GetTimeLine(cx appengine.Context, at Access, p martini.Params, w http.ResponseWriter) {
+// GetTimeLine - get the timeline for the user (token, ?renditions=a,b&size=WxH&fit=) : TlResp
+// Likes change too often to keep a version, so the ETag is a hash of the reply.  The URLs are
+// for the formats the Accept header prefers.
+func GetTimeLine(cx appengine.Context, at Access, p martini.Params, w http.ResponseWriter, r *http.Request) {
 	tl, err := getTimeline(cx, at.ID(), p["lastid"])
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	replyJSON(w, Timeline{"abelana#timeline", tl})
+	if replyVersion(w) != apiV1 {
+		signEntries(cx, at.ID(), tl, r)
+	}
+	w.Header().Add("Vary", "Accept")
+	replyVersioned(w, r, "", Timeline{"abelana#timeline", tl})
 }
 
-// GetMyProfile - Get my entries only (token) : TlResp
-func GetMyProfile(cx appengine.Context, at Access, p martini.Params, w http.ResponseWriter) {
+// GetMyProfile - Get my entries only (token, ?renditions=a,b&size=WxH&fit=) : TlResp
+func GetMyProfile(cx appengine.Context, at Access, p martini.Params, w http.ResponseWriter, r *http.Request) {
+	etag := versionETag(w, resourceVersion(cx, at.ID(), "pr"), "pr", at.ID(), p["lastdate"],
+		r.FormValue("renditions"), r.FormValue("size"), r.FormValue("fit"), acceptTag(r), urlEpoch())
+	w.Header().Add("Vary", "Accept")
+	if notModified(w, r, etag) {
+		return
+	}
 	tl, err := profileForUser(cx, at.ID(), p["lastdate"])
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	replyJSON(w, Timeline{"abelana#timeline", tl})
+	if replyVersion(w) != apiV1 {
+		signEntries(cx, at.ID(), tl, r)
+	}
+	replyVersioned(w, r, etag, Timeline{"abelana#timeline", tl})
 }
 
-// FProfile - Get a specific followers entries only (TlfReq) : TlResp
-func FProfile(cx appengine.Context, at Access, p martini.Params, w http.ResponseWriter) {
+// FProfile - Get a specific followers entries only (TlfReq, ?renditions=a,b&size=WxH&fit=) : TlResp
+// Private accounts are only shown to their followers.
+func FProfile(cx appengine.Context, at Access, p martini.Params, w http.ResponseWriter, r *http.Request) {
+	owner, err := findUser(cx, p["personid"])
+	switch {
+	case err == datastore.ErrNoSuchEntity:
+		http.Error(w, "no such user", http.StatusNotFound)
+		return
+	case err != nil:
+		cx.Errorf("FProfile %v %v", p["personid"], err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	case !canSee(at.ID(), owner):
+		http.Error(w, "private account", http.StatusForbidden)
+		return
+	}
+	etag := versionETag(w, resourceVersion(cx, p["personid"], "pr"), "pr", p["personid"], p["lastdate"],
+		r.FormValue("renditions"), r.FormValue("size"), r.FormValue("fit"), acceptTag(r), urlEpoch())
+	w.Header().Add("Vary", "Accept")
+	if notModified(w, r, etag) {
+		return
+	}
 	tl, err := profileForUser(cx, p["personid"], p["lastdate"])
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	replyJSON(w, Timeline{"abelana#timeline", tl})
+	if replyVersion(w) != apiV1 {
+		signEntries(cx, at.ID(), tl, r)
+	}
+	replyVersioned(w, r, etag, Timeline{"abelana#timeline", tl})
 }
 
 // profileForUser will get the 300 most recent photos from the user, we don't provide any info
@@ -266,12 +468,16 @@ func profileForUser(cx appengine.Context, userID, lastDate string) ([]TLEntry, e
 	var tl []TLEntry
 	for _, p := range photos {
 		tl = append(tl, TLEntry{
-			Created: p.Date,
-			UserID:  userID,
-			Name:    u.DisplayName,
-			PhotoID: p.PhotoID,
-			Likes:   -1, // TODO: don't return the likes in the profile for users
-			ILike:   false},
+			Created:  p.Date,
+			UserID:   userID,
+			Name:     u.DisplayName,
+			PhotoID:  p.PhotoID,
+			Likes:    -1, // TODO: don't return the likes in the profile for users
+			ILike:    false,
+			Color:    p.Color,
+			BlurHash: p.BlurHash,
+			Animated: p.Animated,
+			Formats:  parseFormats(p.Formats)},
 		)
 	}
 	if DEBUG {
@@ -294,7 +500,11 @@ func Import(cx appengine.Context, at Access, p martini.Params, w http.ResponseWr
 ///////////////////////////////////////////////////////////////////////////////////////////////////
 
 // GetFollowing - A list of those I follow (AToken) :
-func GetFollowing(cx appengine.Context, at Access, p martini.Params, w http.ResponseWriter) {
+func GetFollowing(cx appengine.Context, at Access, p martini.Params, w http.ResponseWriter, r *http.Request) {
+	etag := versionETag(w, resourceVersion(cx, at.ID(), "fl"), "fl", at.ID())
+	if notModified(w, r, etag) {
+		return
+	}
 	var u User
 	err := datastore.Get(cx, datastore.NewKey(cx, "User", at.ID(), 0, nil), &u)
 	if err != nil {
@@ -308,7 +518,7 @@ func GetFollowing(cx appengine.Context, at Access, p martini.Params, w http.Resp
 		replyOk(w)
 		return
 	}
-	replyJSON(w, Persons{
+	replyVersioned(w, r, etag, Persons{
 		Kind:    "abelana#followerList",
 		Persons: ps,
 	})
@@ -333,6 +543,7 @@ func GetPerson(cx appengine.Context, at Access, p martini.Params, w http.Respons
 }
 
 // FollowByID - will tell us about a new possible follower (FrReq) : Status
+// Following a private account only asks to, see ApproveFollower.
 func FollowByID(cx appengine.Context, at Access, p martini.Params, w http.ResponseWriter) {
 	if err := followById(cx, at.ID(), p["personid"]); err != nil {
 		cx.Errorf("FollowByID: %v", err)
@@ -340,6 +551,87 @@ func FollowByID(cx appengine.Context, at Access, p martini.Params, w http.Respon
 	replyOk(w)
 }
 
+// GetFollowRequests - those asking to follow my private account (Atok) : Persons
+func GetFollowRequests(cx appengine.Context, at Access, w http.ResponseWriter) {
+	u, err := findUser(cx, at.ID())
+	if err != nil {
+		cx.Errorf("GetFollowRequests %v %v", at.ID(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ps, err := getPersons(cx, u.FollowersAsk)
+	if err != nil {
+		cx.Errorf("GetFollowRequests %v %v", at.ID(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	replyJSON(w, &Persons{Kind: "abelana#followRequestList", Persons: ps})
+}
+
+// ApproveFollower - let someone who asked follow me (Atok, personid) : Status
+func ApproveFollower(cx appengine.Context, at Access, p martini.Params, w http.ResponseWriter) {
+	answerFollower(cx, at.ID(), p["personid"], true, w)
+}
+
+// DenyFollower - turn down someone who asked to follow me (Atok, personid) : Status
+func DenyFollower(cx appengine.Context, at Access, p martini.Params, w http.ResponseWriter) {
+	answerFollower(cx, at.ID(), p["personid"], false, w)
+}
+
+// approveFollowers has the followers who asked to follow userID while it was private follow it.
+func approveFollowers(cx appengine.Context, userID string, followers []string) error {
+	for _, f := range followers {
+		if err := followById(cx, f, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errNoFollowRequest is returned for answers to requests nobody made.
+var errNoFollowRequest = errors.New("no such follow request")
+
+// answerFollower takes followerID off the requests of userID, making them a follower if approved.
+func answerFollower(cx appengine.Context, userID, followerID string, approve bool, w http.ResponseWriter) {
+	to := &datastore.TransactionOptions{XG: true}
+	err := datastore.RunInTransaction(cx, func(cx appengine.Context) error {
+		kUser := datastore.NewKey(cx, "User", userID, 0, nil)
+		user := &User{}
+		if err := datastore.Get(cx, kUser, user); err != nil {
+			return fmt.Errorf("getMe %v %v", userID, err)
+		}
+		asked := without(user.FollowersAsk, followerID)
+		if len(asked) == len(user.FollowersAsk) {
+			return errNoFollowRequest
+		}
+		user.FollowersAsk = asked
+		if !approve {
+			_, err := datastore.Put(cx, kUser, user)
+			return err
+		}
+
+		kFollower := datastore.NewKey(cx, "User", followerID, 0, nil)
+		follower := &User{}
+		if err := datastore.Get(cx, kFollower, follower); err != nil {
+			return fmt.Errorf("getFollower %v %v", followerID, err)
+		}
+		return addFollower(cx, kFollower, follower, kUser, user)
+	}, to)
+	switch {
+	case err == errNoFollowRequest:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		cx.Errorf("answerFollower %v %v %v", userID, followerID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if approve {
+		startFollowing(cx, followerID, userID)
+	}
+	replyOk(w)
+}
+
 // Follow will see if we can follow the user, given their email
 func Follow(cx appengine.Context, at Access, p martini.Params, w http.ResponseWriter) {
 	var users []User
@@ -408,10 +700,13 @@ func findFollows(cx appengine.Context, userID, email string) error {
 	return nil
 }
 
-// followById makes following a user easy once we know who they are
+// followById makes following a user easy once we know who they are.  Private accounts get a
+// follow request instead, userID follows once they approve it.
 func followById(cx appengine.Context, userID, followingID string) error {
+	var asked bool
 	to := &datastore.TransactionOptions{XG: true}
 	err := datastore.RunInTransaction(cx, func(cx appengine.Context) error {
+		asked = false
 		user := &User{}
 		kUser := datastore.NewKey(cx, "User", userID, 0, nil)
 		err := datastore.Get(cx, kUser, user)
@@ -429,31 +724,63 @@ func followById(cx appengine.Context, userID, followingID string) error {
 			cx.Infof("followByID: (%v %v)%v %v", len(user.IFollow), cap(user.IFollow), userID, followingID)
 		}
 
-		if uniqueP(user.IFollow, followingID) { // Only add if Unique
-			user.IFollow = append(user.IFollow, followingID)
-			_, err = datastore.Put(cx, kUser, user)
-			if err != nil {
-				return fmt.Errorf("updateMe %v %v", userID, err)
-			}
-		}
-
-		if uniqueP(followed.FollowsMe, userID) {
-			followed.FollowsMe = append(followed.FollowsMe, userID)
-			_, err = datastore.Put(cx, kFollowed, followed)
-			if err != nil {
-				return fmt.Errorf("updateFollowed %v %v", followingID, err)
+		if followed.Private && userID != followingID && uniqueP(followed.FollowsMe, userID) {
+			asked = true
+			if uniqueP(followed.FollowersAsk, userID) {
+				followed.FollowersAsk = append(followed.FollowersAsk, userID)
+				if _, err := datastore.Put(cx, kFollowed, followed); err != nil {
+					return fmt.Errorf("askFollowed %v %v", followingID, err)
+				}
 			}
+			return nil
 		}
-		return nil
+		return addFollower(cx, kUser, user, kFollowed, followed)
 	}, to)
 
-	if err != nil {
+	if err != nil || asked {
 		return err
 	}
-	delayINowFollow.Call(cx, userID, followingID)
+	startFollowing(cx, userID, followingID)
+	return nil
+}
+
+// addFollower records that user follows followed, it's called in a transaction over both.
+func addFollower(cx appengine.Context, kUser *datastore.Key, user *User, kFollowed *datastore.Key, followed *User) error {
+	if uniqueP(user.IFollow, kFollowed.StringID()) { // Only add if Unique
+		user.IFollow = append(user.IFollow, kFollowed.StringID())
+		if _, err := datastore.Put(cx, kUser, user); err != nil {
+			return fmt.Errorf("updateMe %v %v", kUser.StringID(), err)
+		}
+	}
+
+	if uniqueP(followed.FollowsMe, kUser.StringID()) {
+		followed.FollowsMe = append(followed.FollowsMe, kUser.StringID())
+		if _, err := datastore.Put(cx, kFollowed, followed); err != nil {
+			return fmt.Errorf("updateFollowed %v %v", kFollowed.StringID(), err)
+		}
+	}
 	return nil
 }
 
+// startFollowing brings the timeline of userID up to date now that they follow followingID.
+func startFollowing(cx appengine.Context, userID, followingID string) {
+	if err := bumpVersion(cx, userID, "fl"); err != nil {
+		cx.Errorf("startFollowing: %v %v", userID, err)
+	}
+	delayINowFollow.Call(cx, userID, followingID)
+}
+
+// without returns list less every item.
+func without(list []string, item string) []string {
+	var l []string
+	for _, itm := range list {
+		if itm != item {
+			l = append(l, itm)
+		}
+	}
+	return l
+}
+
 // uniqueP helps us find and elimiate duplicates
 func uniqueP(list []string, item string) bool {
 	for _, itm := range list {
@@ -496,12 +823,14 @@ func SetPhotoComments(cx appengine.Context, at Access, p martini.Params, w http.
 	_, err := datastore.Put(cx, k3, c)
 	if err != nil {
 		cx.Errorf("SetPhotoComments: %v %v", k3, err)
+	} else if err = bumpVersion(cx, photoID, "cm"); err != nil {
+		cx.Errorf("SetPhotoComments: %v %v", photoID, err)
 	}
 	replyOk(w)
 }
 
 // GetPhotoComments will get the comments given a photoid
-func GetPhotoComments(cx appengine.Context, at Access, p martini.Params, w http.ResponseWriter) {
+func GetPhotoComments(cx appengine.Context, at Access, p martini.Params, w http.ResponseWriter, r *http.Request) {
 	var c []Comment
 
 	s := strings.Split(p["photoid"], ".")
@@ -510,6 +839,10 @@ func GetPhotoComments(cx appengine.Context, at Access, p martini.Params, w http.
 		return
 	}
 	userID, photoID := s[0], p["photoid"]
+	etag := versionETag(w, resourceVersion(cx, photoID, "cm"), "cm", photoID)
+	if notModified(w, r, etag) {
+		return
+	}
 	k1 := datastore.NewKey(cx, "User", userID, 0, nil)
 	k2 := datastore.NewKey(cx, "Photo", photoID, 0, k1)
 
@@ -521,7 +854,7 @@ func GetPhotoComments(cx appengine.Context, at Access, p martini.Params, w http.
 		return
 	}
 	cl := &Comments{"abelana#comments", c}
-	replyJSON(w, cl)
+	replyVersioned(w, r, etag, cl)
 }
 
 // Like let's the user tell of their joy (Photo) : Status
@@ -574,13 +907,65 @@ func Flag(cx appengine.Context, at Access, p martini.Params, w http.ResponseWrit
 		replyOk(w)
 		return
 	}
-	flag(cx, at.ID(), p["photoid"])
+	if _, err := flag(cx, at.ID(), p["photoid"]); err != nil {
+		cx.Errorf("Flag: %v %v", p["photoid"], err)
+	}
 
 	//  We should also write something to Datastore
 
 	replyOk(w)
 }
 
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Moderation, app.yaml keeps /admin to the administrators of the app
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+// maxFlagged is how many photos the moderation queue shows at once.
+const maxFlagged = 100
+
+// GetFlagged lists the most flagged photos : Flagged
+func GetFlagged(cx appengine.Context, w http.ResponseWriter) {
+	if !user.IsAdmin(cx) {
+		http.Error(w, "not authorized", http.StatusForbidden)
+		return
+	}
+	fl, err := flagged(cx, maxFlagged)
+	if err != nil {
+		cx.Errorf("GetFlagged: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	replyJSON(w, &Flagged{"abelana#flagged", fl})
+}
+
+// BlockPhoto takes a flagged photo down for good: it stays off the timelines and its copies can't
+// be posted again.
+func BlockPhoto(cx appengine.Context, p martini.Params, w http.ResponseWriter) string {
+	if !user.IsAdmin(cx) {
+		http.Error(w, "not authorized", http.StatusForbidden)
+		return ``
+	}
+	delayBlockPhoto.Call(cx, p["photoid"])
+	if err := unflag(cx, p["photoid"]); err != nil {
+		cx.Errorf("BlockPhoto: %v %v", p["photoid"], err)
+	}
+	return `ok`
+}
+
+// DismissFlags puts a flagged photo back on the timelines.
+func DismissFlags(cx appengine.Context, p martini.Params, w http.ResponseWriter) string {
+	if !user.IsAdmin(cx) {
+		http.Error(w, "not authorized", http.StatusForbidden)
+		return ``
+	}
+	if err := dismissFlags(cx, p["photoid"]); err != nil {
+		cx.Errorf("DismissFlags: %v %v", p["photoid"], err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return ``
+	}
+	return `ok`
+}
+
 // PostPhoto lets us know that we have a photo, we then tell both DataStore and Redis
 // What is sent is just the id, either uuuuu.rrrrr or uuuuu where u=userID, and rrrrr is random photoID
 func PostPhoto(cx appengine.Context, p martini.Params, w http.ResponseWriter, rq *http.Request) string {
@@ -592,9 +977,93 @@ func PostPhoto(cx appengine.Context, p martini.Params, w http.ResponseWriter, rq
 			return ``
 		}
 	}
+	var info PhotoInfo
+	if rq.ContentLength != 0 {
+		if err := json.NewDecoder(rq.Body).Decode(&info); err != nil {
+			cx.Errorf("PostPhoto: bad photo info for %v %v", p["superid"], err)
+		}
+	}
+	info.Trace = rq.Header.Get(traceHeader)
+	cx.Infof("PostPhoto: trace %v %v", info.Trace, p["superid"])
 	s := strings.Split(p["superid"], ".")
 	if len(s) == 2 { // We only need to call for userid.photoID.webp
-		delayAddPhoto.Call(cx, p["superid"])
+		if err := setPhotoState(cx, p["superid"], photoReady, info.Renditions, info.Formats); err != nil {
+			cx.Errorf("PostPhoto: state %v %v", p["superid"], err)
+		}
+		delayAddPhotoInfo.Call(cx, p["superid"], info)
+	}
+	return `ok`
+}
+
+// PostPhotoProcessing lets us know that notice has handed the photo to imagemagick.
+func PostPhotoProcessing(cx appengine.Context, p martini.Params, w http.ResponseWriter, rq *http.Request) string {
+	otok := rq.Header.Get("Authorization")
+	if !appengine.IsDevAppServer() {
+		ok, err := authorized(cx, otok)
+		if !ok || err != nil {
+			http.Error(w, "not authorized", http.StatusUnauthorized)
+			return ``
+		}
+	}
+	s := strings.Split(p["superid"], ".")
+	if len(s) != 2 {
+		return `ok`
+	}
+	if err := setPhotoState(cx, p["superid"], photoProcessing, nil, nil); err != nil {
+		cx.Errorf("PostPhotoProcessing: %v %v", p["superid"], err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return ``
+	}
+	return `ok`
+}
+
+// PostPhotoFailed lets us know that a photo was rejected by imagemagick, it won't be added.
+func PostPhotoFailed(cx appengine.Context, p martini.Params, w http.ResponseWriter, rq *http.Request) string {
+	otok := rq.Header.Get("Authorization")
+	if !appengine.IsDevAppServer() {
+		ok, err := authorized(cx, otok)
+		if !ok || err != nil {
+			http.Error(w, "not authorized", http.StatusUnauthorized)
+			return ``
+		}
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(rq.Body).Decode(&body); err != nil {
+		cx.Errorf("PostPhotoFailed: %v %v", p["superid"], err)
+	}
+	s := strings.Split(p["superid"], ".")
+	if len(s) != 2 {
+		return `ok`
+	}
+	f := &PhotoFailure{p["superid"], body.Reason, time.Now().UTC().Unix()}
+	k := datastore.NewKey(cx, "PhotoFailure", p["superid"], 0,
+		datastore.NewKey(cx, "User", s[0], 0, nil))
+	if _, err := datastore.Put(cx, k, f); err != nil {
+		cx.Errorf("PostPhotoFailed: %v %v", k, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return ``
+	}
+	cx.Warningf("PostPhotoFailed: trace %v %v %v", rq.Header.Get(traceHeader), p["superid"], body.Reason)
+	return `ok`
+}
+
+// PostPhotoDeleted lets us know that the original of a photo was deleted and imagemagick removed
+// its renditions, we take it out of the timelines.
+func PostPhotoDeleted(cx appengine.Context, p martini.Params, w http.ResponseWriter, rq *http.Request) string {
+	otok := rq.Header.Get("Authorization")
+	if !appengine.IsDevAppServer() {
+		ok, err := authorized(cx, otok)
+		if !ok || err != nil {
+			http.Error(w, "not authorized", http.StatusUnauthorized)
+			return ``
+		}
+	}
+	cx.Infof("PostPhotoDeleted: trace %v %v", rq.Header.Get(traceHeader), p["superid"])
+	s := strings.Split(p["superid"], ".")
+	if len(s) == 2 {
+		delayRetirePhoto.Call(cx, p["superid"])
 	}
 	return `ok`
 }
@@ -0,0 +1,127 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package abelana
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/go-martini/martini"
+)
+
+// The states of a photo between the upload and the timeline.
+const (
+	photoPending    = "pending"    // we haven't heard of it yet
+	photoProcessing = "processing" // notice has handed it to imagemagick
+	photoReady      = "ready"      // the renditions exist, it is being added to the timelines
+	photoFailed     = "failed"     // imagemagick rejected it, see PhotoFailure
+	photoDeleted    = "deleted"    // the original was deleted and the photo retired
+)
+
+type (
+	// PhotoState is where the processing of an upload is at, it is kept under the User.  Failures
+	// are kept as PhotoFailure.
+	PhotoState struct {
+		PhotoID    string
+		State      string
+		Renditions []string `datastore:",noindex"` // suffixes of the renditions, when ready
+		Formats    string   `datastore:",noindex"` // and their extensions, see encodeFormats
+		Updated    int64
+	}
+
+	// PhotoStatus is what GetPhotoStatus replies.
+	PhotoStatus struct {
+		Kind        string              `json:"kind"`
+		PhotoID     string              `json:"photoid"`
+		Status      string              `json:"status"`
+		Renditions  []string            `json:"renditions,omitempty"`
+		Formats     map[string][]string `json:"formats,omitempty"`
+		DuplicateOf string              `json:"duplicateof,omitempty"` // a recent photo of the uploader it copies
+		Reason      string              `json:"reason,omitempty"`
+	}
+)
+
+// setPhotoState records the state of photoID, userid.photoid.
+func setPhotoState(cx appengine.Context, photoID, state string, renditions []string, formats map[string][]string) error {
+	s := strings.Split(photoID, ".")
+	st := &PhotoState{photoID, state, renditions, encodeFormats(formats), time.Now().UTC().Unix()}
+	k := datastore.NewKey(cx, "PhotoState", photoID, 0,
+		datastore.NewKey(cx, "User", s[0], 0, nil))
+	_, err := datastore.Put(cx, k, st)
+	return err
+}
+
+// GetPhotoStatus tells the uploader what became of a photo (Atok, PhotoID) : PhotoStatus
+func GetPhotoStatus(cx appengine.Context, at Access, p martini.Params, w http.ResponseWriter) {
+	photoID := p["photoid"]
+	s := strings.Split(photoID, ".")
+	if len(s) != 2 || s[0] != at.ID() {
+		http.Error(w, "not your photo", http.StatusNotFound)
+		return
+	}
+	uk := datastore.NewKey(cx, "User", at.ID(), 0, nil)
+
+	st, ph, f := &PhotoState{}, &Photo{}, &PhotoFailure{}
+	switch err := datastore.Get(cx, datastore.NewKey(cx, "PhotoState", photoID, 0, uk), st); err {
+	case nil:
+	case datastore.ErrNoSuchEntity:
+		st = nil
+	default:
+		cx.Errorf("GetPhotoStatus %v %v", photoID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if datastore.Get(cx, datastore.NewKey(cx, "Photo", photoID, 0, uk), ph) != nil {
+		ph = nil
+	}
+	if datastore.Get(cx, datastore.NewKey(cx, "PhotoFailure", photoID, 0, uk), f) != nil {
+		f = nil
+	}
+	replyJSON(w, photoStatus(photoID, st, ph, f))
+}
+
+// photoStatus works out the status of photoID from its state, its Photo and its failure, each nil
+// if Datastore doesn't have one.
+func photoStatus(photoID string, st *PhotoState, ph *Photo, f *PhotoFailure) *PhotoStatus {
+	ps := &PhotoStatus{Kind: "abelana#photoStatus", PhotoID: photoID, Status: photoPending}
+	var updated int64
+	switch {
+	case st != nil:
+		ps.Status, ps.Renditions, ps.Formats = st.State, st.Renditions, parseFormats(st.Formats)
+		updated = st.Updated
+	case ph != nil:
+		// Photos added before we kept states are ready.
+		ps.Status = photoReady
+	}
+	if ps.Status == photoDeleted {
+		// it's over, whatever happened before
+		return ps
+	}
+
+	if ph != nil {
+		ps.DuplicateOf = ph.DuplicateOf
+	}
+
+	// A failure only counts if it's more recent than the state, the photo may have been uploaded
+	// again since.
+	if f != nil && f.Date >= updated {
+		ps.Status, ps.Renditions, ps.Formats, ps.Reason = photoFailed, nil, nil, f.Reason
+	}
+	return ps
+}
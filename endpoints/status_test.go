@@ -0,0 +1,46 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package abelana
+
+import "testing"
+
+func TestPhotoStatus(t *testing.T) {
+	ready := &PhotoState{PhotoID: "u.p", State: photoReady, Renditions: []string{"a"}, Formats: "a:webp", Updated: 100}
+	for _, tt := range []struct {
+		name   string
+		st     *PhotoState
+		ph     *Photo
+		f      *PhotoFailure
+		status string
+		dup    string
+	}{
+		{"not heard of", nil, nil, nil, photoPending, ""},
+		{"processing", &PhotoState{State: photoProcessing, Updated: 100}, nil, nil, photoProcessing, ""},
+		{"ready", ready, &Photo{DuplicateOf: "u.q"}, nil, photoReady, "u.q"},
+		{"before states", nil, &Photo{}, nil, photoReady, ""},
+		{"failed", &PhotoState{State: photoProcessing, Updated: 100}, nil, &PhotoFailure{Date: 101}, photoFailed, ""},
+		{"uploaded again", ready, &Photo{}, &PhotoFailure{Date: 99}, photoReady, ""},
+		{"deleted", &PhotoState{State: photoDeleted, Updated: 100}, nil, nil, photoDeleted, ""},
+		{"deleted after failing", &PhotoState{State: photoDeleted, Updated: 100}, nil, &PhotoFailure{Date: 101}, photoDeleted, ""},
+	} {
+		ps := photoStatus("u.p", tt.st, tt.ph, tt.f)
+		if ps.Status != tt.status || ps.DuplicateOf != tt.dup {
+			t.Errorf("%s: status %q duplicate of %q, want %q %q", tt.name, ps.Status, ps.DuplicateOf, tt.status, tt.dup)
+		}
+		if ps.Status != photoReady && len(ps.Renditions) > 0 {
+			t.Errorf("%s: renditions %v with status %q", tt.name, ps.Renditions, ps.Status)
+		}
+	}
+}
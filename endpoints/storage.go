@@ -0,0 +1,48 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package abelana
+
+import (
+	"net/http"
+
+	"appengine"
+	"appengine/urlfetch"
+
+	"code.google.com/p/goauth2/oauth"
+
+	"github.com/GoogleCloudPlatform/abelana-gcp/imagemagick/blobstore"
+	"google.golang.org/cloud"
+)
+
+// photoStore returns the blob store selected by StorageKind, GCS unless told otherwise.  The
+// local store only makes sense under the development server, production instances can't write
+// to their file system.
+func photoStore(cx appengine.Context) (blobstore.Store, error) {
+	cfg := abelanaConfig()
+	if cfg.StorageKind == blobstore.KindLocal {
+		return blobstore.Open(cfg.StorageKind, nil, cfg.StorageDir)
+	}
+
+	tok, _, err := appengine.AccessToken(cx, "https://www.googleapis.com/auth/devstorage.read_write")
+	if err != nil {
+		return nil, err
+	}
+	transport := &oauth.Transport{
+		Token:     &oauth.Token{AccessToken: tok},
+		Transport: &urlfetch.Transport{Context: cx},
+	}
+	ctx := cloud.NewContext(cfg.ProjectID, &http.Client{Transport: transport})
+	return blobstore.Open(cfg.StorageKind, ctx, cfg.StorageDir)
+}
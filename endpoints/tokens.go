@@ -102,6 +102,11 @@ func Login(cx appengine.Context, p martini.Params, w http.ResponseWriter) {
 			true, "abelana-app.com", "LES001"}
 		dName = "Les Vogel"
 		photoURL = "https://lh4.googleusercontent.com/-Nt9PfYHmQeI/AAAAAAAAAAI/AAAAAAAAANI/2mbohwDXFKI/photo.jpg?sz=50"
+	} else if id := devUser(p["gittok"]); id != "" {
+		// Lets the development harness log in as many users as it needs.
+		err = nil
+		token = &gitkit.Token{LocalID: id, Email: id + "@example.com", EmailVerified: true,
+			IssueAt: time.Now().UTC(), ExpireAt: time.Now().UTC().Add(1 * time.Hour)}
 	} else {
 		token, err = client.ValidateToken(p["gittok"])
 		if err != nil {
@@ -147,6 +152,15 @@ func Login(cx appengine.Context, p martini.Params, w http.ResponseWriter) {
 	}
 }
 
+// devUser returns the user id of a "Dev<id>" gitkit token, which is only accepted by the
+// development server with the backdoor enabled.
+func devUser(gittok string) string {
+	if !abelanaConfig().EnableBackdoor || !appengine.IsDevAppServer() || !strings.HasPrefix(gittok, "Dev") {
+		return ""
+	}
+	return strings.TrimPrefix(gittok, "Dev")
+}
+
 // Refresh will refresh an Access Token (ATok)
 func Refresh(cx appengine.Context, p martini.Params, w http.ResponseWriter) {
 	//	haveCerts(cx)
@@ -181,6 +195,8 @@ func Refresh(cx appengine.Context, p martini.Params, w http.ResponseWriter) {
 }
 
 // GetSecretKey will send our key in a way that we should only be called once.
+//
+// Deprecated: only v1 serves it, v2 clients upload with the URLs of PostUpload.
 func GetSecretKey(w http.ResponseWriter) {
 	st := &Status{"abelana#status", base64.URLEncoding.EncodeToString([]byte(abelanaConfig().ServerKey))}
 	replyJSON(w, st)
@@ -217,9 +233,13 @@ func (at *AccToken) ID() string {
 }
 
 // Aauth validates a given AccessToken
-func Aauth(c martini.Context, cx appengine.Context, p martini.Params, w http.ResponseWriter) {
+func Aauth(c martini.Context, cx appengine.Context, p martini.Params, w http.ResponseWriter, r *http.Request) {
 	var at *AccToken
 
+	if batchAuth(c, r) {
+		return
+	}
+
 	if abelanaConfig().EnableBackdoor && strings.HasPrefix(p["atok"], "LES") {
 		at = &AccToken{"00001", time.Now().UTC().Unix(),
 			time.Now().UTC().Add(120 * 24 * time.Hour).Unix()}
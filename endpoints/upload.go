@@ -0,0 +1,228 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package abelana
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"appengine"
+)
+
+// Defaults for the upload URLs, used when the config leaves them out.
+const (
+	defaultUploadMaxBytes = 20 << 20 // what imagemagick accepts
+	defaultUploadExpiry   = 15 * time.Minute
+)
+
+// uploadTypes are the content types we accept uploads of, with the extension of their objects.
+var uploadTypes = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+}
+
+// UploadURL tells the client where to PUT a photo, it must send Headers along.
+type UploadURL struct {
+	Kind    string            `json:"kind"`
+	PhotoID string            `json:"photoid"`
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Expires int64             `json:"expires"`
+}
+
+// PostUpload allocates a photo id and returns a URL the client can upload it to without any
+// credentials of its own (Atok, ?type=image/jpeg) : UploadURL
+func PostUpload(cx appengine.Context, at Access, w http.ResponseWriter, r *http.Request) {
+	ct := r.FormValue("type")
+	if ct == "" {
+		ct = "image/jpeg"
+	}
+	ext, ok := uploadTypes[ct]
+	if !ok {
+		http.Error(w, "unsupported content type", http.StatusBadRequest)
+		return
+	}
+	photoID, err := newPhotoID(at.ID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	cfg := abelanaConfig()
+	if cfg.UploadBucket == "" {
+		cx.Errorf("PostUpload: no UploadBucket in the config")
+		http.Error(w, "uploads aren't configured", http.StatusInternalServerError)
+		return
+	}
+	max := cfg.UploadMaxBytes
+	if max <= 0 {
+		max = defaultUploadMaxBytes
+	}
+	expiry := time.Duration(cfg.UploadExpirySeconds) * time.Second
+	if expiry <= 0 {
+		expiry = defaultUploadExpiry
+	}
+	headers := map[string]string{
+		"Content-Type":                ct,
+		"X-Goog-Content-Length-Range": fmt.Sprintf("0,%d", max),
+	}
+
+	s := appSigner(cx)
+	u, err := s.signedURL("PUT", cfg.UploadBucket, photoID+"."+ext, headers, expiry)
+	if err != nil {
+		cx.Errorf("PostUpload: sign %v %v", photoID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	replyJSON(w, &UploadURL{"abelana#uploadUrl", photoID, "PUT", u, headers, s.now().Add(expiry).Unix()})
+}
+
+// newPhotoID returns a new userid.random photo id.
+func newPhotoID(userID string) (string, error) {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return "", fmt.Errorf("photo id: %v", err)
+	}
+	return userID + "." + n.Text(36), nil
+}
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// V4 signed URLs, see https://cloud.google.com/storage/docs/access-control/signed-urls
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+const (
+	storageHost  = "storage.googleapis.com"
+	v4Algorithm  = "GOOG4-RSA-SHA256"
+	v4DateFormat = "20060102T150405Z"
+	v4MaxExpiry  = 7 * 24 * time.Hour
+)
+
+// urlSigner signs Cloud Storage URLs as a service account.  The signing function and the clock
+// are fields so that signatures can be checked offline with a fixed key and time.
+type urlSigner struct {
+	email string                         // of the service account
+	sign  func(b []byte) ([]byte, error) // RSA SHA-256 signature with the account's key
+	now   func() time.Time
+}
+
+// appSigner signs as the application's own service account.
+func appSigner(cx appengine.Context) *urlSigner {
+	email, err := appengine.ServiceAccount(cx)
+	if err != nil {
+		cx.Errorf("appSigner: service account %v", err)
+	}
+	return &urlSigner{
+		email: email,
+		sign: func(b []byte) ([]byte, error) {
+			_, sig, err := appengine.SignBytes(cx, b)
+			return sig, err
+		},
+		now: time.Now,
+	}
+}
+
+// signedURL returns a URL for method on the object, valid for expiry.  The headers are signed,
+// the request must carry them with exactly these values.
+func (s *urlSigner) signedURL(method, bucket, object string, headers map[string]string, expiry time.Duration) (string, error) {
+	if s.email == "" {
+		return "", fmt.Errorf("no service account to sign with")
+	}
+	if bucket == "" || object == "" {
+		return "", fmt.Errorf("no bucket or object to sign for")
+	}
+	if expiry <= 0 || expiry > v4MaxExpiry {
+		return "", fmt.Errorf("expiry %v out of range", expiry)
+	}
+	t := s.now().UTC()
+	date := t.Format(v4DateFormat)
+	scope := t.Format("20060102") + "/auto/storage/goog4_request"
+
+	canon := map[string]string{"host": storageHost}
+	for k, v := range headers {
+		canon[strings.ToLower(k)] = strings.TrimSpace(v)
+	}
+	names := make([]string, 0, len(canon))
+	for k := range canon {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var ch string
+	for _, k := range names {
+		ch += k + ":" + canon[k] + "\n"
+	}
+	signed := strings.Join(names, ";")
+
+	query := map[string]string{
+		"X-Goog-Algorithm":     v4Algorithm,
+		"X-Goog-Credential":    s.email + "/" + scope,
+		"X-Goog-Date":          date,
+		"X-Goog-Expires":       fmt.Sprint(int64(expiry / time.Second)),
+		"X-Goog-SignedHeaders": signed,
+	}
+	qs := canonicalQuery(query)
+	path := "/" + bucket + "/" + escapePath(object)
+
+	req := strings.Join([]string{method, path, qs, ch, signed, "UNSIGNED-PAYLOAD"}, "\n")
+	h := sha256.Sum256([]byte(req))
+	toSign := strings.Join([]string{v4Algorithm, date, scope, hex.EncodeToString(h[:])}, "\n")
+
+	sig, err := s.sign([]byte(toSign))
+	if err != nil {
+		return "", fmt.Errorf("sign: %v", err)
+	}
+	return "https://" + storageHost + path + "?" + qs + "&X-Goog-Signature=" + hex.EncodeToString(sig), nil
+}
+
+// canonicalQuery sorts the parameters by name and escapes them the way V4 signatures want.
+func canonicalQuery(q map[string]string) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = escapeV4(k) + "=" + escapeV4(q[k])
+	}
+	return strings.Join(parts, "&")
+}
+
+// escapePath escapes every segment of an object name, keeping the slashes.
+func escapePath(name string) string {
+	segs := strings.Split(name, "/")
+	for i, s := range segs {
+		segs[i] = escapeV4(s)
+	}
+	return strings.Join(segs, "/")
+}
+
+// escapeV4 percent encodes everything but the unreserved characters of RFC 3986.
+func escapeV4(s string) string {
+	// url.QueryEscape gets close, but encodes spaces as + and leaves ~ alone only since Go 1.5.
+	e := url.QueryEscape(s)
+	e = strings.Replace(e, "+", "%20", -1)
+	return strings.Replace(e, "%7E", "~", -1)
+}
@@ -16,18 +16,11 @@ package abelana
 
 import (
 	"fmt"
-	"io"
-	"net/http"
 	"strings"
 
 	"appengine"
 	"appengine/datastore"
 	"appengine/urlfetch"
-
-	"code.google.com/p/goauth2/oauth"
-
-	"google.golang.org/cloud"
-	"google.golang.org/cloud/storage"
 )
 
 // findUser Lookup the user (This can be called from a Transaction)
@@ -84,29 +77,13 @@ func copyUserPhoto(cx appengine.Context, url string, userID string) error {
 		return err
 	}
 
-	tok, _, err := appengine.AccessToken(cx, "https://www.googleapis.com/auth/devstorage.read_write")
+	store, err := photoStore(cx)
 	if err != nil {
-		cx.Errorf(" AccessToken %v", err)
+		cx.Errorf(" photoStore %v", err)
 		return err
 	}
-
-	transport := &oauth.Transport{
-		Token:     &oauth.Token{AccessToken: tok},
-		Transport: &urlfetch.Transport{Context: cx},
-	}
-	clnt := &http.Client{Transport: transport}
-
-	ctx := cloud.NewContext(abelanaConfig().ProjectID, clnt)
-	w := storage.NewWriter(ctx, abelanaConfig().Bucket, userID+".jpg", &storage.Object{ContentType: "image/jpg"})
-	defer w.Close()
-
-	_, err = io.Copy(w, resp.Body)
-
-	if err := w.Close(); err != nil {
-		cx.Errorf(" cup closing %v", err)
-	}
-	if _, err := w.Object(); err != nil {
-		cx.Errorf("  .Object %v", err)
+	if err := store.Put(abelanaConfig().Bucket, userID+".jpg", "image/jpg", resp.Body); err != nil {
+		cx.Errorf(" cup put %v", err)
 	}
 	cx.Infof("CopyUserPhoto ok %v %v", userID, url)
 	return nil
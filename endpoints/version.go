@@ -0,0 +1,186 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package abelana
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/go-martini/martini"
+)
+
+// The API is mounted once per version.  The handlers in server.go always speak the current
+// version (v2); older versions are adapters that rewrite each reply into the shape that shipped
+// clients were built against, so the handlers can evolve without breaking the Android app.
+const (
+	apiV1      = "v1"
+	apiV2      = "v2"
+	apiCurrent = apiV2
+)
+
+// versionedWriter carries the API version of the route down to replyJSON.
+type versionedWriter struct {
+	http.ResponseWriter
+	version string
+}
+
+// responseTransformers rewrite a v2 reply into the shape of an older version.  Versions without
+// a transformer get the reply as is.
+var responseTransformers = map[string]func(interface{}) interface{}{
+	apiV1: toV1,
+}
+
+// apiVersion returns the martini handler that tags a route group with its version. Anything but
+// the current version is answered with a deprecation notice pointing at its successor.
+func apiVersion(version string) martini.Handler {
+	return func(c martini.Context, w http.ResponseWriter, r *http.Request) {
+		if version != apiCurrent {
+			h := w.Header()
+			h.Set("Deprecation", "true")
+			h.Add("Link", `<`+successorPath(r.URL.Path, version)+`>; rel="successor-version"`)
+			h.Add("Warning", `299 - "API `+version+` is deprecated, please upgrade to `+apiCurrent+`"`)
+		}
+		c.MapTo(&versionedWriter{w, version}, (*http.ResponseWriter)(nil))
+	}
+}
+
+// replyVersion returns the API version w replies in, the current one outside of a route group.
+func replyVersion(w http.ResponseWriter) string {
+	if vw, ok := w.(*versionedWriter); ok {
+		return vw.version
+	}
+	return apiCurrent
+}
+
+// successorPath maps a request path of an older version onto the current version.
+func successorPath(path, version string) string {
+	return "/" + apiCurrent + strings.TrimPrefix(path, "/"+version)
+}
+
+// transformReply rewrites v for the API version the request came in on.
+func transformReply(w http.ResponseWriter, v interface{}) interface{} {
+	vw, ok := w.(*versionedWriter)
+	if !ok {
+		return v
+	}
+	if t, ok := responseTransformers[vw.version]; ok {
+		return t(v)
+	}
+	return v
+}
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// v1 -- FROZEN. These are the shapes the first Android client shipped with, do not change them.
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+type (
+	v1TLEntry struct {
+		Created int64  `json:"created"`
+		UserID  string `json:"userid"`
+		Name    string `json:"name"`
+		PhotoID string `json:"photoid"`
+		Likes   int    `json:"likes"`
+		ILike   bool   `json:"ilike"`
+	}
+
+	v1Timeline struct {
+		Kind    string      `json:"kind"`
+		Entries []v1TLEntry `json:"entries"`
+	}
+
+	v1Person struct {
+		Kind     string `json:"kind,omitempty"`
+		PersonID string `json:"personid"`
+		Email    string `json:"email,omitempty"`
+		Name     string `json:"name"`
+	}
+
+	v1Persons struct {
+		Kind    string     `json:"kind"`
+		Persons []v1Person `json:"persons"`
+	}
+
+	v1Comment struct {
+		PersonID string `json:"personid"`
+		Text     string `json:"text"`
+		Time     int64  `json:"time"`
+	}
+
+	v1Comments struct {
+		Kind    string      `json:"kind"`
+		Entries []v1Comment `json:"entries"`
+	}
+
+	v1Stats struct {
+		Following int `json:"following"`
+		Followers int `json:"followers"`
+	}
+)
+
+// toV1 converts a reply into its v1 shape.  Replies we don't know about (Status, ATOKJson) have
+// never changed and are passed through.
+func toV1(v interface{}) interface{} {
+	switch t := v.(type) {
+	case Timeline:
+		return v1TimelineOf(&t)
+	case *Timeline:
+		return v1TimelineOf(t)
+	case Persons:
+		return v1PersonsOf(&t)
+	case *Persons:
+		return v1PersonsOf(t)
+	case Person:
+		return v1PersonOf(&t)
+	case *Person:
+		return v1PersonOf(t)
+	case Comments:
+		return v1CommentsOf(&t)
+	case *Comments:
+		return v1CommentsOf(t)
+	case Stats:
+		return &v1Stats{t.Following, t.Followers}
+	case *Stats:
+		return &v1Stats{t.Following, t.Followers}
+	}
+	return v
+}
+
+func v1TimelineOf(tl *Timeline) *v1Timeline {
+	r := &v1Timeline{Kind: tl.Kind}
+	for _, e := range tl.Entries {
+		r.Entries = append(r.Entries, v1TLEntry{e.Created, e.UserID, e.Name, e.PhotoID, e.Likes, e.ILike})
+	}
+	return r
+}
+
+func v1PersonOf(p *Person) *v1Person {
+	return &v1Person{p.Kind, p.PersonID, p.Email, p.Name}
+}
+
+func v1PersonsOf(ps *Persons) *v1Persons {
+	r := &v1Persons{Kind: ps.Kind}
+	for i := range ps.Persons {
+		r.Persons = append(r.Persons, *v1PersonOf(&ps.Persons[i]))
+	}
+	return r
+}
+
+func v1CommentsOf(cl *Comments) *v1Comments {
+	r := &v1Comments{Kind: cl.Kind}
+	for _, c := range cl.Entries {
+		r.Entries = append(r.Entries, v1Comment{c.PersonID, c.Text, c.Time})
+	}
+	return r
+}
@@ -0,0 +1,88 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package abelana
+
+import (
+	"net/http"
+	"strings"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/GoogleCloudPlatform/abelana-gcp/third_party/redisx"
+	"github.com/go-martini/martini"
+)
+
+// Attribution is what imagemagick needs to watermark the renditions shared outside the app.
+type Attribution struct {
+	Name      string `json:"name"`
+	Watermark bool   `json:"watermark"` // false if the owner opted out
+}
+
+// SetWatermark lets users opt out of the watermark on their shared photos (Atok, on|off) : Status
+// It only applies to the photos uploaded afterwards.
+func SetWatermark(cx appengine.Context, at Access, p martini.Params, w http.ResponseWriter) {
+	var off bool
+	switch p["onoff"] {
+	case "on":
+	case "off":
+		off = true
+	default:
+		http.Error(w, "watermark is on or off", http.StatusBadRequest)
+		return
+	}
+	err := datastore.RunInTransaction(cx, func(cx appengine.Context) error {
+		u, err := findUser(cx, at.ID())
+		if err != nil {
+			return err
+		}
+		u.NoWatermark = off
+		_, err = datastore.Put(cx, datastore.NewKey(cx, "User", at.ID(), 0, nil), u)
+		return err
+	}, nil)
+	if err != nil {
+		cx.Errorf("SetWatermark %v %v", at.ID(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	replyOk(w)
+}
+
+// GetAttribution tells imagemagick whose photo it is rendering and if they want the watermark.
+func GetAttribution(cx appengine.Context, p martini.Params, w http.ResponseWriter, rq *http.Request) {
+	if !appengine.IsDevAppServer() {
+		ok, err := authorized(cx, rq.Header.Get("Authorization"))
+		if !ok || err != nil {
+			http.Error(w, "not authorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	s := strings.Split(p["superid"], ".")
+	u, err := findUser(cx, s[0])
+	if err != nil {
+		cx.Errorf("GetAttribution: %v %v", p["superid"], err)
+		http.Error(w, "no such user", http.StatusNotFound)
+		return
+	}
+
+	// The name shown in the timelines is the one in Redis.
+	conn := pool.Get(cx)
+	defer conn.Close()
+	name, err := redisx.String(conn.Do("HGET", "HT:"+s[0], "dn"))
+	if err != nil || name == "" {
+		name = u.DisplayName
+	}
+	replyJSON(w, &Attribution{name, !u.NoWatermark})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gographics/imagick/imagick"
+)
+
+// Defaults of the animation caps, used when the config leaves them out.
+const (
+	defaultMaxFrames   = 100
+	defaultMaxDuration = 10 // seconds
+)
+
+// animatedFormats are the output formats that keep every frame, renditions in the others are a
+// still of the first frame.
+var animatedFormats = map[string]bool{"WEBP": true, "GIF": true}
+
+// Animation decides what becomes of uploads with more than one frame, animated GIFs and WebPs.
+// They are either animated in the renditions or reduced to a poster frame, the first one.
+type Animation struct {
+	Animate     bool    // animate the renditions, otherwise every upload gets the poster frame
+	MaxFrames   uint    // longer animations get the poster frame, defaults to 100
+	MaxDuration float64 // seconds, longer animations get the poster frame, defaults to 10
+}
+
+func (a *Animation) validate() error {
+	if a.MaxDuration < 0 {
+		return fmt.Errorf("negative MaxDuration")
+	}
+	if a.MaxFrames == 0 {
+		a.MaxFrames = defaultMaxFrames
+	}
+	if a.MaxDuration == 0 {
+		a.MaxDuration = defaultMaxDuration
+	}
+	return nil
+}
+
+// coalesce returns the frames of the image, each one the full picture as it is displayed rather
+// than the difference to the previous one, and whether they are to be animated.  Animations that
+// we don't animate come back as their poster frame.  wand is destroyed when it is replaced, which
+// it isn't on errors.
+//
+// Coalesced frames are each the size of the canvas, however small the frames were, so the caps and
+// maxPixels are checked before making them: a few thousand tiny frames on a large canvas would
+// otherwise take gigabytes.  The poster frame is the only one coalesced when there's no animation.
+func coalesce(rl *requestLog, wand *imagick.MagickWand, a *Animation, maxPixels uint64) (*imagick.MagickWand, bool, error) {
+	n := wand.GetNumberImages()
+	if n <= 1 {
+		return wand, false, nil
+	}
+	wand.SetFirstIterator()
+	cw, ch, _, _, err := wand.GetImagePage()
+	if err != nil {
+		return wand, false, fmt.Errorf("canvas: %v", err)
+	}
+	if cw == 0 || ch == 0 {
+		cw, ch = wand.GetImageWidth(), wand.GetImageHeight()
+	}
+	canvas := uint64(cw) * uint64(ch)
+	if canvas > maxPixels {
+		return wand, false, reject("%dx%d canvas, more than %d pixels", cw, ch, maxPixels)
+	}
+	d := duration(wand)
+
+	if a.Animate && n <= a.MaxFrames && d <= a.MaxDuration && uint64(n)*canvas <= maxPixels {
+		frames := wand.CoalesceImages()
+		if frames.GetNumberImages() == 0 {
+			frames.Destroy()
+			return wand, false, reject("coalesce %d frames failed", n)
+		}
+		wand.Destroy()
+		frames.SetFirstIterator()
+		rl.Infof("animated, %d frames, %.1fs", n, d)
+		return frames, true, nil
+	}
+
+	rl.Infof("%d frames on a %dx%d canvas, %.1fs, keeping the poster frame", n, cw, ch, d)
+	first := wand.GetImage()
+	poster := first.CoalesceImages() // the first frame on its canvas
+	first.Destroy()
+	if poster.GetNumberImages() == 0 {
+		poster.Destroy()
+		return wand, false, reject("poster frame failed")
+	}
+	wand.Destroy()
+	poster.SetFirstIterator()
+	return poster, false, nil
+}
+
+// duration returns how long the animation plays once, in seconds.
+func duration(wand *imagick.MagickWand) float64 {
+	var d float64
+	wand.ResetIterator()
+	for wand.NextImage() {
+		tps := wand.GetImageTicksPerSecond()
+		if tps == 0 {
+			tps = 100 // the GIF default
+		}
+		d += float64(wand.GetImageDelay()) / float64(tps)
+	}
+	wand.SetFirstIterator()
+	return d
+}
+
+// eachFrame calls f with every frame of the wand in turn as its current image, then leaves the
+// first one current.  Most of the wand methods only touch the current image.
+func eachFrame(wand *imagick.MagickWand, f func() error) error {
+	defer wand.SetFirstIterator()
+	wand.ResetIterator()
+	for wand.NextImage() {
+		if err := f(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resizeFrames resizes every frame of the wand to the rendition.
+func resizeFrames(wand *imagick.MagickWand, rend *Rendition) error {
+	if wand.GetNumberImages() > 1 && rend.Fit == fitSmart {
+		// The window would jump around from frame to frame, animations are cropped in the centre.
+		r := *rend
+		r.Fit = fitFill
+		rend = &r
+	}
+	return eachFrame(wand, func() error {
+		return resize(wand, rend)
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gographics/imagick/imagick"
+)
+
+// animation returns n frames of 10x10 on a 100x100 canvas, a tenth of a second each.
+func animation(t *testing.T, n int) *imagick.MagickWand {
+	colour := imagick.NewPixelWand()
+	defer colour.Destroy()
+	wand := imagick.NewMagickWand()
+	for i := 0; i < n; i++ {
+		colour.SetColor([]string{"red", "green", "blue"}[i%3])
+		frame := imagick.NewMagickWand()
+		err := frame.NewImage(10, 10, colour)
+		if err == nil {
+			err = frame.SetImagePage(100, 100, 10*i, 10*i)
+		}
+		if err == nil {
+			err = frame.SetImageDelay(10)
+		}
+		if err == nil {
+			err = wand.AddImage(frame)
+		}
+		frame.Destroy()
+		if err != nil {
+			wand.Destroy()
+			t.Fatal(err)
+		}
+	}
+	return wand
+}
+
+func TestCoalesce(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		anim      Animation
+		maxPixels uint64
+		frames    uint // 0 for a rejection
+		animated  bool
+	}{
+		{"animated", Animation{true, 10, 10}, 1e6, 3, true},
+		{"not animating", Animation{false, 10, 10}, 1e6, 1, false},
+		{"too many frames", Animation{true, 2, 10}, 1e6, 1, false},
+		{"too long", Animation{true, 10, 0.2}, 1e6, 1, false},
+		// 3 coalesced frames are 30000 pixels, the poster 10000
+		{"too large to coalesce", Animation{true, 10, 10}, 25000, 1, false},
+		{"canvas too large", Animation{true, 10, 10}, 5000, 0, false},
+	} {
+		wand := animation(t, 3)
+		got, animated, err := coalesce(&requestLog{}, wand, &tt.anim, tt.maxPixels)
+		if tt.frames == 0 {
+			if _, ok := err.(*rejectError); !ok {
+				t.Errorf("%s: got %v, want a rejection", tt.name, err)
+			}
+			got.Destroy()
+			continue
+		}
+		if err != nil {
+			got.Destroy()
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		n, w, h := got.GetNumberImages(), got.GetImageWidth(), got.GetImageHeight()
+		got.Destroy()
+		if n != tt.frames || animated != tt.animated {
+			t.Errorf("%s: %d frames animated %v, want %d animated %v", tt.name, n, animated, tt.frames, tt.animated)
+		}
+		if w != 100 || h != 100 {
+			t.Errorf("%s: frames of %dx%d, want the 100x100 canvas", tt.name, w, h)
+		}
+	}
+}
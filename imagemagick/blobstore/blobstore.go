@@ -0,0 +1,63 @@
+// Package blobstore is a small interface over object storage, so that the services can run
+// against Google Cloud Storage in production and a local directory during development.
+package blobstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"code.google.com/p/go.net/context"
+)
+
+// ErrNotExist is returned when reading an object that isn't there.
+var ErrNotExist = errors.New("blobstore: object doesn't exist")
+
+// ErrInvalidName is returned for bucket or object names a store can't hold, such as names that
+// would lead out of the root of a local store.
+var ErrInvalidName = errors.New("blobstore: invalid bucket or object name")
+
+// Kinds of stores, as named in the configuration of the services.
+const (
+	KindGCS   = "gcs"
+	KindLocal = "local"
+)
+
+// ObjectInfo is what Stat tells us about an object.
+type ObjectInfo struct {
+	Bucket      string
+	Name        string
+	ContentType string
+	Size        int64
+	Updated     time.Time
+}
+
+// Store reads and writes objects in buckets.
+type Store interface {
+	// Get opens the object for reading, the caller must close it.
+	Get(bucket, name string) (io.ReadCloser, error)
+	// Put creates or replaces the object with the contents of r.
+	Put(bucket, name, contentType string, r io.Reader) error
+	// Delete removes the object, deleting an object that isn't there is not an error.
+	Delete(bucket, name string) error
+	// List returns the names of the objects starting with prefix, in lexical order.
+	List(bucket, prefix string) ([]string, error)
+	// Stat returns information about the object.
+	Stat(bucket, name string) (*ObjectInfo, error)
+}
+
+// Open returns the store of the given kind.  ctx is the cloud context for GCS, dir the root of
+// the local store, where each bucket is a directory.
+func Open(kind string, ctx context.Context, dir string) (Store, error) {
+	switch kind {
+	case "", KindGCS:
+		return NewGCS(ctx), nil
+	case KindLocal:
+		if dir == "" {
+			return nil, fmt.Errorf("blobstore: local store needs a directory")
+		}
+		return NewLocal(dir), nil
+	}
+	return nil, fmt.Errorf("blobstore: unknown kind %q", kind)
+}
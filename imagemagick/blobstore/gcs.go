@@ -0,0 +1,85 @@
+package blobstore
+
+import (
+	"io"
+	"sort"
+
+	"code.google.com/p/go.net/context"
+	"google.golang.org/cloud/storage"
+)
+
+// GCS stores objects in Google Cloud Storage.
+type GCS struct {
+	ctx context.Context
+}
+
+// NewGCS returns a store using the cloud context ctx, see cloud.NewContext.
+func NewGCS(ctx context.Context) *GCS {
+	return &GCS{ctx}
+}
+
+func (s *GCS) Get(bucket, name string) (io.ReadCloser, error) {
+	r, err := storage.NewReader(s.ctx, bucket, name)
+	if err == storage.ErrObjectNotExists {
+		return nil, ErrNotExist
+	}
+	return r, err
+}
+
+func (s *GCS) Put(bucket, name, contentType string, r io.Reader) error {
+	var info *storage.Object
+	if contentType != "" {
+		info = &storage.Object{ContentType: contentType}
+	}
+	w := storage.NewWriter(s.ctx, bucket, name, info)
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	_, err := w.Object()
+	return err
+}
+
+func (s *GCS) Delete(bucket, name string) error {
+	err := storage.Delete(s.ctx, bucket, name)
+	if err == storage.ErrObjectNotExists {
+		return nil
+	}
+	return err
+}
+
+func (s *GCS) List(bucket, prefix string) ([]string, error) {
+	var names []string
+	for q := (&storage.Query{Prefix: prefix}); q != nil; {
+		objs, err := storage.List(s.ctx, bucket, q)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range objs.Results {
+			names = append(names, o.Name)
+		}
+		q = objs.Next
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *GCS) Stat(bucket, name string) (*ObjectInfo, error) {
+	o, err := storage.Stat(s.ctx, bucket, name)
+	if err == storage.ErrObjectNotExists {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{
+		Bucket:      o.Bucket,
+		Name:        o.Name,
+		ContentType: o.ContentType,
+		Size:        int64(o.Size),
+		Updated:     o.Updated,
+	}, nil
+}
@@ -0,0 +1,192 @@
+package blobstore
+
+import (
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// metaDir holds the content types of the objects of a local bucket, it is never listed.
+const metaDir = ".meta"
+
+// Local stores objects as files under a root directory, one directory per bucket.  Object names
+// may contain slashes, they become subdirectories.
+type Local struct {
+	Root string
+}
+
+// NewLocal returns a store rooted at dir.
+func NewLocal(dir string) *Local {
+	return &Local{dir}
+}
+
+// bucketDir returns the directory of the bucket, the bucket must be a single path element.
+func (s *Local) bucketDir(bucket string) (string, error) {
+	if bucket == "" || bucket == "." || bucket == ".." || strings.ContainsAny(bucket, `/\`) {
+		return "", ErrInvalidName
+	}
+	return filepath.Join(s.Root, bucket), nil
+}
+
+func (s *Local) path(bucket, name string) (string, error) {
+	return s.under(bucket, "", name)
+}
+
+func (s *Local) metaPath(bucket, name string) (string, error) {
+	return s.under(bucket, metaDir, name)
+}
+
+// under returns the file of the object in dir of the bucket.  Names leading out of the bucket,
+// or into metaDir, are refused.
+func (s *Local) under(bucket, dir, name string) (string, error) {
+	root, err := s.bucketDir(bucket)
+	if err != nil {
+		return "", err
+	}
+	sep := string(filepath.Separator)
+	rel := filepath.Clean(filepath.FromSlash(name))
+	if name == "" || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+sep) || filepath.IsAbs(rel) ||
+		rel == metaDir || strings.HasPrefix(rel, metaDir+sep) {
+		return "", ErrInvalidName
+	}
+	return filepath.Join(root, dir, rel), nil
+}
+
+func (s *Local) Get(bucket, name string) (io.ReadCloser, error) {
+	p, err := s.path(bucket, name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	return f, err
+}
+
+// Put writes to a temporary file and renames it, so readers never see half an object.
+func (s *Local) Put(bucket, name, contentType string, r io.Reader) error {
+	p, err := s.path(bucket, name)
+	if err != nil {
+		return err
+	}
+	mp, err := s.metaPath(bucket, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if contentType == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(mp), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(mp, []byte(contentType), 0644)
+}
+
+func (s *Local) Delete(bucket, name string) error {
+	p, err := s.path(bucket, name)
+	if err != nil {
+		return err
+	}
+	mp, err := s.metaPath(bucket, name)
+	if err != nil {
+		return err
+	}
+	os.Remove(mp)
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *Local) List(bucket, prefix string) ([]string, error) {
+	root, err := s.bucketDir(bucket)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	err = filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if fi.IsDir() {
+			if fi.Name() == metaDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(fi.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *Local) Stat(bucket, name string) (*ObjectInfo, error) {
+	p, err := s.path(bucket, name)
+	if err != nil {
+		return nil, err
+	}
+	mp, err := s.metaPath(bucket, name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	ct := mime.TypeByExtension(filepath.Ext(name))
+	if b, err := ioutil.ReadFile(mp); err == nil {
+		ct = string(b)
+	}
+	return &ObjectInfo{
+		Bucket:      bucket,
+		Name:        name,
+		ContentType: ct,
+		Size:        fi.Size(),
+		Updated:     fi.ModTime(),
+	}, nil
+}
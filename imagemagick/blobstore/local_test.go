@@ -0,0 +1,57 @@
+package blobstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	s := NewLocal(root)
+
+	for _, tt := range []struct{ bucket, name string }{
+		{"..", "x"},
+		{".", "x"},
+		{"", "x"},
+		{"a/b", "x"},
+		{"b", ""},
+		{"b", ".."},
+		{"b", "../c/x"},
+		{"b", "../../escaped"},
+		{"b", "x/../../escaped"},
+		{"b", "/etc/passwd"},
+		{"b", ".meta/x"},
+	} {
+		if err := s.Put(tt.bucket, tt.name, "text/plain", strings.NewReader("x")); err != ErrInvalidName {
+			t.Errorf("Put(%q, %q): %v, want ErrInvalidName", tt.bucket, tt.name, err)
+		}
+		if _, err := s.Get(tt.bucket, tt.name); err != ErrInvalidName {
+			t.Errorf("Get(%q, %q): %v, want ErrInvalidName", tt.bucket, tt.name, err)
+		}
+		if err := s.Delete(tt.bucket, tt.name); err != ErrInvalidName {
+			t.Errorf("Delete(%q, %q): %v, want ErrInvalidName", tt.bucket, tt.name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("an object was written outside the root")
+	}
+
+	if err := s.Put("b", "u/p.jpg", "image/jpeg", strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := s.Stat("b", "u/./p.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ContentType != "image/jpeg" || info.Size != 1 {
+		t.Errorf("Stat: %+v", info)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Fit modes of a rendition.
+const (
+	fitInside = "fit"   // scale to fit inside the box, keeping the aspect ratio
+	fitFill   = "fill"  // scale to cover the box, keeping the aspect ratio, and crop the centre
+	fitExact  = "exact" // scale to exactly the box, distorting the image if needed
+	fitSmart  = "smart" // like fill, but crop the region with the most detail instead of the centre
+)
+
+// Config holds everything the server needs to know about its environment and what to render.
+type Config struct {
+	ProjectID    string
+	InputBucket  string // where clients upload the originals, the only bucket we process or delete
+	OutputBucket string
+	PushURL      string
+	AuthEmail    string
+	TokenInfoURL string // base URL of the OAuth2 API checking our callers, defaults to Google's
+	Storage      Storage
+	Limits       Limits
+	Workers      Workers
+	Renditions   []Rendition
+	Quality      map[string]uint // compression quality by format, for renditions without their own
+	Watermark    Watermark
+	Animation    Animation
+	Proxy        Proxy
+}
+
+// Storage selects where originals are read from and renditions written to.  It is only read
+// on start.
+type Storage struct {
+	Kind string // "gcs", the default, or "local"
+	Dir  string // root of the local store, every bucket is a directory under it
+}
+
+// Rendition describes one of the images we generate for every upload.
+type Rendition struct {
+	Suffix  string // appended to the name of the original, userid.photoid_<suffix>.<format>
+	Width   uint   // bounding box
+	Height  uint
+	Fit     string   // one of the fit modes above, defaults to exact
+	Format  string   // ImageMagick format name, the first of Formats once validated
+	Formats []string // ImageMagick format names the rendition is written in, defaults to WEBP
+	Quality uint     // compression quality 1-100 in every format, 0 uses the per format Quality
+	Strip   bool     // remove profiles and comments from the output
+
+	Watermark bool // a public share size, it gets the Watermark unless the owner opted out
+}
+
+// Ext is the file extension of the rendition in its first format.
+func (r *Rendition) Ext() string {
+	return extOf(r.Format)
+}
+
+// objectName returns the name of the rendition of the photo base in format.
+func (r *Rendition) objectName(base, format string) string {
+	return fmt.Sprintf("%s_%s.%s", base, r.Suffix, extOf(format))
+}
+
+// extOf returns the file extension of an ImageMagick format, it is also the subtype of its
+// content type.
+func extOf(format string) string {
+	return strings.ToLower(format)
+}
+
+// quality returns the compression quality of the rendition in format, 0 for the ImageMagick
+// default.
+func (c *Config) quality(rend *Rendition, format string) uint {
+	if rend.Quality > 0 {
+		return rend.Quality
+	}
+	return c.Quality[format]
+}
+
+var (
+	configMu sync.RWMutex
+	config   *Config
+)
+
+// currentConfig returns the active configuration, callers should hold on to the result for the
+// duration of a request as it may be replaced by a reload.
+func currentConfig() *Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return config
+}
+
+// loadConfig reads and validates the configuration in path.
+func loadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config %q: %v", path, err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parse config %q: %v", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("config %q: %v", path, err)
+	}
+	return &cfg, nil
+}
+
+// validate checks the configuration and fills in the defaults.
+func (c *Config) validate() error {
+	if c.ProjectID == "" || c.InputBucket == "" || c.OutputBucket == "" || c.PushURL == "" || c.AuthEmail == "" {
+		return fmt.Errorf("ProjectID, InputBucket, OutputBucket, PushURL and AuthEmail are required")
+	}
+	if err := c.Limits.validate(); err != nil {
+		return fmt.Errorf("limits: %v", err)
+	}
+	c.Workers.validate()
+	if err := c.Watermark.validate(); err != nil {
+		return fmt.Errorf("watermark: %v", err)
+	}
+	if err := c.Animation.validate(); err != nil {
+		return fmt.Errorf("animation: %v", err)
+	}
+	if c.Proxy.InputBucket == "" {
+		c.Proxy.InputBucket = c.InputBucket
+	}
+	if err := c.Proxy.validate(); err != nil {
+		return fmt.Errorf("proxy: %v", err)
+	}
+	if len(c.Renditions) == 0 {
+		return fmt.Errorf("no renditions")
+	}
+	seen := make(map[string]bool)
+	for i := range c.Renditions {
+		r := &c.Renditions[i]
+		if r.Suffix == "" {
+			return fmt.Errorf("rendition %d: missing suffix", i)
+		}
+		if seen[r.Suffix] {
+			return fmt.Errorf("rendition %q: duplicated suffix", r.Suffix)
+		}
+		seen[r.Suffix] = true
+		if r.Width == 0 || r.Height == 0 {
+			return fmt.Errorf("rendition %q: empty bounding box", r.Suffix)
+		}
+		switch r.Fit {
+		case "":
+			r.Fit = fitExact
+		case fitInside, fitFill, fitExact, fitSmart:
+		default:
+			return fmt.Errorf("rendition %q: unknown fit mode %q", r.Suffix, r.Fit)
+		}
+		// Format alone is how a rendition was written in a single format.
+		if r.Format != "" {
+			r.Formats = append([]string{r.Format}, r.Formats...)
+		}
+		if len(r.Formats) == 0 {
+			r.Formats = []string{"WEBP"}
+		}
+		formats := make(map[string]bool)
+		var uniq []string
+		for _, f := range r.Formats {
+			if f = strings.ToUpper(f); !formats[f] {
+				formats[f] = true
+				uniq = append(uniq, f)
+			}
+		}
+		r.Formats, r.Format = uniq, uniq[0]
+		if r.Quality > 100 {
+			return fmt.Errorf("rendition %q: quality %d out of range", r.Suffix, r.Quality)
+		}
+	}
+	quality := make(map[string]uint, len(c.Quality))
+	for f, q := range c.Quality {
+		if q > 100 {
+			return fmt.Errorf("%s quality %d out of range", f, q)
+		}
+		quality[strings.ToUpper(f)] = q
+	}
+	c.Quality = quality
+	return nil
+}
+
+// mustLoadConfig loads the configuration at startup and reloads it on SIGHUP.  A broken file on
+// reload is logged and the previous configuration stays in place.
+func mustLoadConfig(path string) {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config = cfg
+	setResourceLimits(&cfg.Limits)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for _ = range hup {
+			cfg, err := loadConfig(path)
+			if err != nil {
+				log.Printf("reload: %v", err)
+				continue
+			}
+			configMu.Lock()
+			config = cfg
+			configMu.Unlock()
+			setResourceLimits(&cfg.Limits)
+			log.Printf("reloaded config from %q, %d renditions", path, len(cfg.Renditions))
+		}
+	}()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/abelana-gcp/imagemagick/blobstore"
+)
+
+// written runs processImage on the landscape fixture, uploaded as u.p.png, with cfg and a local
+// store, and returns the names of the objects it wrote to the output bucket.
+func written(t *testing.T, cfg *Config) []string {
+	dir, err := ioutil.TempDir("", "renditions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local := blobstore.NewLocal(dir)
+	img, err := ioutil.ReadFile("testdata/landscape.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := local.Put("in", "u.p.png", "image/png", bytes.NewReader(img)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The watermark would ask endpoints for the owner, the names don't depend on it.
+	run := *cfg
+	run.Watermark = Watermark{}
+	configMu.Lock()
+	savedConfig, savedStore := config, store
+	config, store = &run, local
+	configMu.Unlock()
+	defer func() {
+		configMu.Lock()
+		config, store = savedConfig, savedStore
+		configMu.Unlock()
+	}()
+
+	r, _ := http.NewRequest("POST", "/", nil)
+	if _, err := processImage(newRequestLog(r, "in", "u.p.png"), "in", "u.p.png", ""); err != nil {
+		t.Fatal(err)
+	}
+	names, err := local.List(run.OutputBucket, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestLoadConfig(t *testing.T) {
+	for _, tt := range []struct {
+		path string
+		err  string
+	}{
+		{path: "testdata/defaults.json"},
+		{path: "testdata/formats.json"},
+		{path: "config.json"},
+		{path: "testdata/duplicate.json", err: "duplicated suffix"},
+		{path: "testdata/badfit.json", err: `unknown fit mode "stretch"`},
+		{path: "testdata/missing.json", err: "read config"},
+	} {
+		_, err := loadConfig(tt.path)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: got error %v, want %q", tt.path, err, tt.err)
+		}
+	}
+}
+
+// Every rendition is written in each of its formats.
+func TestWrittenObjects(t *testing.T) {
+	for _, tt := range []struct {
+		path    string
+		objects []string
+	}{
+		{"testdata/defaults.json", []string{"u.p_a.webp"}},
+		{"testdata/formats.json", []string{"u.p_a.jpeg", "u.p_b.jpeg", "u.p_b.png", "u.p_b.webp"}},
+		{"config.json", []string{
+			"u.p_a.jpeg", "u.p_a.webp", "u.p_b.jpeg", "u.p_b.webp", "u.p_c.jpeg", "u.p_c.webp",
+			"u.p_d.jpeg", "u.p_d.webp", "u.p_e.jpeg", "u.p_e.webp", "u.p_f.jpeg", "u.p_f.webp",
+			"u.p_g.jpeg", "u.p_g.webp", "u.p_h.jpeg", "u.p_h.webp", "u.p_i.jpeg", "u.p_i.webp",
+		}},
+	} {
+		cfg, err := loadConfig(tt.path)
+		if err != nil {
+			t.Errorf("%s: %v", tt.path, err)
+			continue
+		}
+		if got := written(t, cfg); !reflect.DeepEqual(got, tt.objects) {
+			t.Errorf("%s: wrote %v, want %v", tt.path, got, tt.objects)
+		}
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	cfg, err := loadConfig("testdata/defaults.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := cfg.Renditions[0]
+	if r.Fit != fitExact {
+		t.Errorf("fit %q, want %q", r.Fit, fitExact)
+	}
+	if r.Format != "WEBP" || !reflect.DeepEqual(r.Formats, []string{"WEBP"}) {
+		t.Errorf("format %q %v, want WEBP", r.Format, r.Formats)
+	}
+	if cfg.Limits.MaxBytes != defaultMaxBytes || cfg.Limits.MaxPixels != defaultMaxPixels {
+		t.Errorf("limits %d bytes %d pixels, want the defaults", cfg.Limits.MaxBytes, cfg.Limits.MaxPixels)
+	}
+	if !reflect.DeepEqual(cfg.Limits.InputFormats, defaultInputFormats) {
+		t.Errorf("input formats %v, want %v", cfg.Limits.InputFormats, defaultInputFormats)
+	}
+	if cfg.Animation.MaxFrames != defaultMaxFrames || cfg.Animation.MaxDuration != defaultMaxDuration {
+		t.Errorf("animation caps %d frames %vs, want the defaults", cfg.Animation.MaxFrames, cfg.Animation.MaxDuration)
+	}
+}
+
+func TestConfigFormats(t *testing.T) {
+	cfg, err := loadConfig("testdata/formats.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := &cfg.Renditions[0], &cfg.Renditions[1]
+	if a.Format != "JPEG" || !reflect.DeepEqual(a.Formats, []string{"JPEG"}) {
+		t.Errorf("a: format %q %v, want JPEG", a.Format, a.Formats)
+	}
+	// Format goes first, the duplicate PNG is dropped.
+	if want := []string{"PNG", "WEBP", "JPEG"}; b.Format != "PNG" || !reflect.DeepEqual(b.Formats, want) {
+		t.Errorf("b: format %q %v, want PNG %v", b.Format, b.Formats, want)
+	}
+	for _, tt := range []struct {
+		rend   *Rendition
+		format string
+		want   uint
+	}{
+		{a, "JPEG", 85},
+		{a, "WEBP", 80},
+		{a, "PNG", 0},
+		{b, "WEBP", 90},
+	} {
+		if got := cfg.quality(tt.rend, tt.format); got != tt.want {
+			t.Errorf("quality of %s in %s: %d, want %d", tt.rend.Suffix, tt.format, got, tt.want)
+		}
+	}
+}
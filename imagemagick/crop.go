@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gographics/imagick/imagick"
+)
+
+// smartProbeSize is the longest side of the thumbnail we look for interesting regions in.
+const smartProbeSize = 64
+
+// resize scales the image to the bounding box of the rendition according to its fit mode.
+func resize(wand *imagick.MagickWand, rend *Rendition) error {
+	if rend.Fit == fitExact {
+		return wand.AdaptiveResizeImage(rend.Width, rend.Height)
+	}
+
+	cover := rend.Fit == fitFill || rend.Fit == fitSmart
+	w, h := scaleTo(wand.GetImageWidth(), wand.GetImageHeight(), rend.Width, rend.Height, cover)
+	if err := wand.AdaptiveResizeImage(w, h); err != nil {
+		return err
+	}
+	if !cover {
+		return nil
+	}
+
+	x, y := centreOffset(w, h, rend.Width, rend.Height)
+	if rend.Fit == fitSmart {
+		var err error
+		if x, y, err = smartOffset(wand, rend.Width, rend.Height); err != nil {
+			return fmt.Errorf("smart crop: %v", err)
+		}
+	}
+	if err := wand.CropImage(rend.Width, rend.Height, x, y); err != nil {
+		return fmt.Errorf("crop: %v", err)
+	}
+	return wand.SetImagePage(rend.Width, rend.Height, 0, 0)
+}
+
+// scaleTo returns the size of a w x h image scaled, keeping its aspect ratio, to fit inside the
+// bw x bh box, or to cover it if cover is set.
+func scaleTo(w, h, bw, bh uint, cover bool) (uint, uint) {
+	sx, sy := float64(bw)/float64(w), float64(bh)/float64(h)
+	s := sx
+	if (cover && sy > sx) || (!cover && sy < sx) {
+		s = sy
+	}
+	nw, nh := uint(float64(w)*s+0.5), uint(float64(h)*s+0.5)
+	if nw == 0 {
+		nw = 1
+	}
+	if nh == 0 {
+		nh = 1
+	}
+	if cover {
+		// rounding must not leave us smaller than the box we crop to
+		if nw < bw {
+			nw = bw
+		}
+		if nh < bh {
+			nh = bh
+		}
+	}
+	return nw, nh
+}
+
+// centreOffset returns the offset of a bw x bh window centred on a w x h image.
+func centreOffset(w, h, bw, bh uint) (x, y int) {
+	return int(w-bw) / 2, int(h-bh) / 2
+}
+
+// smartOffset returns the offset of the bw x bh window of the image with the most detail.  The
+// image has been scaled to cover the window, so it only ever slides along one axis.  We look at
+// the edges of a small grayscale copy and pick the window with the highest mean, ties go to the
+// one closest to the centre.
+func smartOffset(wand *imagick.MagickWand, bw, bh uint) (x, y int, err error) {
+	w, h := wand.GetImageWidth(), wand.GetImageHeight()
+	x, y = centreOffset(w, h, bw, bh)
+	if w == bw && h == bh {
+		return x, y, nil
+	}
+
+	probe := wand.Clone()
+	defer probe.Destroy()
+	pw, ph := scaleTo(w, h, smartProbeSize, smartProbeSize, false)
+	if err := probe.ScaleImage(pw, ph); err != nil {
+		return 0, 0, err
+	}
+	if err := probe.TransformImageColorspace(imagick.COLORSPACE_GRAY); err != nil {
+		return 0, 0, err
+	}
+	if err := probe.EdgeImage(1); err != nil {
+		return 0, 0, err
+	}
+
+	// the window, in probe pixels
+	ww, wh := bw*pw/w, bh*ph/h
+	if ww == 0 {
+		ww = 1
+	}
+	if wh == 0 {
+		wh = 1
+	}
+	slack, horizontal := int(ph-wh), false
+	if w-bw > h-bh {
+		slack, horizontal = int(pw-ww), true
+	}
+	if slack <= 0 {
+		return x, y, nil
+	}
+
+	best, bestDist, bestOff := -1.0, slack, slack/2
+	for off := 0; off <= slack; off++ {
+		px, py := 0, off
+		if horizontal {
+			px, py = off, 0
+		}
+		region := probe.GetImageRegion(ww, wh, px, py)
+		mean, _, err := region.GetImageChannelMean(imagick.CHANNELS_DEFAULT)
+		region.Destroy()
+		if err != nil {
+			return 0, 0, err
+		}
+		dist := off - slack/2
+		if dist < 0 {
+			dist = -dist
+		}
+		if mean > best || (mean == best && dist < bestDist) {
+			best, bestDist, bestOff = mean, dist, off
+		}
+	}
+
+	if horizontal {
+		x = clampOffset(bestOff*int(w)/int(pw), int(w-bw))
+	} else {
+		y = clampOffset(bestOff*int(h)/int(ph), int(h-bh))
+	}
+	return x, y, nil
+}
+
+func clampOffset(off, max int) int {
+	if off < 0 {
+		return 0
+	}
+	if off > max {
+		return max
+	}
+	return off
+}
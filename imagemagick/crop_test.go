@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/gographics/imagick/imagick"
+)
+
+// The fixtures are flat grey with a checkerboard in one region: landscape.png is 400x300 with
+// the detail in its right quarter, portrait.png is 300x400 with the detail in its top quarter.
+
+func TestMain(m *testing.M) {
+	imagick.Initialize()
+	code := m.Run()
+	imagick.Terminate()
+	os.Exit(code)
+}
+
+// readFixture returns a wand with the image in testdata.
+func readFixture(t *testing.T, name string) *imagick.MagickWand {
+	b, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wand := imagick.NewMagickWand()
+	if err := wand.ReadImageBlob(b); err != nil {
+		wand.Destroy()
+		t.Fatalf("%s: %v", name, err)
+	}
+	return wand
+}
+
+func TestScaleTo(t *testing.T) {
+	for _, tt := range []struct {
+		w, h, bw, bh uint
+		cover        bool
+		ww, wh       uint
+	}{
+		{400, 300, 200, 200, false, 200, 150},
+		{400, 300, 200, 200, true, 267, 200},
+		{300, 400, 200, 200, false, 150, 200},
+		{300, 400, 200, 200, true, 200, 267},
+		{4000, 1, 100, 100, false, 100, 1}, // never 0 pixels
+		{999, 1000, 100, 100, true, 100, 100},
+	} {
+		w, h := scaleTo(tt.w, tt.h, tt.bw, tt.bh, tt.cover)
+		if w != tt.ww || h != tt.wh {
+			t.Errorf("scaleTo(%d, %d, %d, %d, %v) = %dx%d, want %dx%d", tt.w, tt.h, tt.bw, tt.bh, tt.cover, w, h, tt.ww, tt.wh)
+		}
+	}
+}
+
+func TestCentreOffset(t *testing.T) {
+	for _, tt := range []struct {
+		w, h, bw, bh uint
+		x, y         int
+	}{
+		{267, 200, 200, 200, 33, 0},
+		{200, 267, 200, 200, 0, 33},
+		{200, 200, 200, 200, 0, 0},
+	} {
+		if x, y := centreOffset(tt.w, tt.h, tt.bw, tt.bh); x != tt.x || y != tt.y {
+			t.Errorf("centreOffset(%d, %d, %d, %d) = %d,%d, want %d,%d", tt.w, tt.h, tt.bw, tt.bh, x, y, tt.x, tt.y)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	for _, tt := range []struct {
+		fixture string
+		fit     string
+		w, h    uint
+	}{
+		{"landscape.png", fitInside, 200, 150},
+		{"landscape.png", fitFill, 200, 200},
+		{"landscape.png", fitExact, 200, 200},
+		{"landscape.png", fitSmart, 200, 200},
+		{"portrait.png", fitInside, 150, 200},
+		{"portrait.png", fitFill, 200, 200},
+		{"portrait.png", fitExact, 200, 200},
+		{"portrait.png", fitSmart, 200, 200},
+	} {
+		wand := readFixture(t, tt.fixture)
+		err := resize(wand, &Rendition{Suffix: "t", Width: 200, Height: 200, Fit: tt.fit})
+		w, h := wand.GetImageWidth(), wand.GetImageHeight()
+		_, _, x, y, _ := wand.GetImagePage()
+		wand.Destroy()
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.fixture, tt.fit, err)
+			continue
+		}
+		if w != tt.w || h != tt.h {
+			t.Errorf("%s %s: %dx%d, want %dx%d", tt.fixture, tt.fit, w, h, tt.w, tt.h)
+		}
+		if x != 0 || y != 0 {
+			t.Errorf("%s %s: page offset %d,%d left behind", tt.fixture, tt.fit, x, y)
+		}
+	}
+}
+
+func TestSmartOffset(t *testing.T) {
+	for _, tt := range []struct {
+		fixture string
+		x, y    int
+	}{
+		{"landscape.png", 67, 0}, // as far right as the window goes
+		{"portrait.png", 0, 0},   // the top
+	} {
+		wand := readFixture(t, tt.fixture)
+		w, h := scaleTo(wand.GetImageWidth(), wand.GetImageHeight(), 200, 200, true)
+		if err := wand.AdaptiveResizeImage(w, h); err != nil {
+			t.Fatal(err)
+		}
+		x, y, err := smartOffset(wand, 200, 200)
+		wand.Destroy()
+		if err != nil {
+			t.Errorf("%s: %v", tt.fixture, err)
+			continue
+		}
+		if x != tt.x || y != tt.y {
+			t.Errorf("%s: crop at %d,%d, want %d,%d", tt.fixture, x, y, tt.x, tt.y)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/abelana-gcp/imagemagick/blobstore"
+)
+
+// deleteHandler is called by notice when an original is deleted, it removes the renditions and
+// tells endpoints to retire the photo.
+func deleteHandler(w http.ResponseWriter, r *http.Request) {
+	bucket, name := r.PostFormValue("bucket"), r.PostFormValue("name")
+	if bucket == "" || name == "" {
+		http.Error(w, "missing bucket or name", http.StatusBadRequest)
+		return
+	}
+
+	rl := newRequestLog(r, bucket, name)
+	token := r.Header.Get("Authorization")
+	if ok, err := authorized(token); !ok {
+		if err != nil {
+			rl.Errorf("authorize: %v", err)
+		}
+		http.Error(w, "you're not authorized", http.StatusForbidden)
+		return
+	}
+	if bucket != currentConfig().InputBucket {
+		// The renditions are named after the photo alone, they'd be those of someone else's.
+		http.Error(w, "not the input bucket", http.StatusForbidden)
+		return
+	}
+
+	if !flight.begin() {
+		busy(w, "shutting down")
+		return
+	}
+	defer flight.end()
+
+	start := time.Now()
+	err := deleteImage(rl, bucket, name, token)
+	rl.Done(start, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func deleteImage(rl *requestLog, bucket, name, token string) error {
+	// A notification for an old generation may arrive after the photo was uploaded again, the
+	// renditions are then those of the new upload.
+	if _, err := store.Stat(bucket, name); err != blobstore.ErrNotExist {
+		if err != nil {
+			return fmt.Errorf("stat original: %v", err)
+		}
+		rl.Infof("original exists again, keeping the renditions")
+		return nil
+	}
+
+	base := name
+	if sep := strings.LastIndex(base, "."); sep >= 0 {
+		base = base[:sep]
+	}
+	// We list rather than use the configured renditions, they may have changed since.
+	cfg := currentConfig()
+	names, err := store.List(cfg.OutputBucket, base+"_")
+	if err != nil {
+		return fmt.Errorf("list renditions: %v", err)
+	}
+	for _, n := range names {
+		if err := store.Delete(cfg.OutputBucket, n); err != nil {
+			return fmt.Errorf("delete %s: %v", n, err)
+		}
+	}
+	rl.Infof("deleted %d renditions", len(names))
+	return notifyDeleted(rl, base, token)
+}
+
+// notifyDeleted tells endpoints the photo is gone.
+func notifyDeleted(rl *requestLog, photoID, token string) error {
+	req, err := http.NewRequest("POST", currentConfig().PushURL+photoID+"/deleted", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", token)
+	req.Header.Set(traceHeader, rl.trace)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("photo deleted push: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("photo deleted push status: %v", res.Status)
+	}
+	return nil
+}
@@ -2,15 +2,16 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"time"
 
 	"runtime"
 	"strings"
+	"sync/atomic"
 
 	"code.google.com/p/go.net/context"
 	auth "code.google.com/p/google-api-go-client/oauth2/v2"
@@ -18,55 +19,67 @@ import (
 	"github.com/gographics/imagick/imagick"
 	"github.com/golang/oauth2/google"
 	"google.golang.org/cloud"
-	"google.golang.org/cloud/storage"
-)
 
-const (
-	projectID     = "abelana-222"
-	outputBucket  = "abelana"
-	listenAddress = "0.0.0.0:8080"
-	pushURL       = "https://endpoints-dot-abelana-222.appspot.com/photopush/"
-	authEmail     = "abelana-222@appspot.gserviceaccount.com"
+	"github.com/GoogleCloudPlatform/abelana-gcp/imagemagick/blobstore"
 )
 
+// statusRejected tells the notice module that the image can't be processed and that it shouldn't
+// retry.
+const statusRejected = 422
+
 var (
-	account = flag.String("account", "service-account.json", "path to service account JSON file")
-
-	// map with the suffixes and sizes to generate
-	sizes = map[string]struct{ x, y uint }{
-		"a": {480, 800},
-		"b": {768, 768},
-		"c": {1080, 1080},
-		"d": {1440, 1440},
-		"e": {1200, 1200},
-		"f": {1536, 1536},
-		"g": {720, 720},
-		"h": {640, 640},
-		"i": {750, 750},
-	}
-
-	ctx    context.Context
-	client *http.Client
+	listen     = flag.String("listen", "0.0.0.0:8080", "address to listen on")
+	certFile   = flag.String("cert", "", "TLS certificate, with -key serves HTTPS")
+	keyFile    = flag.String("key", "", "TLS private key")
+	account    = flag.String("account", "service-account.json", "path to service account JSON file, empty to call endpoints without credentials during local development")
+	configPath = flag.String("config", "config.json", "path to the JSON config with the renditions to generate, reloaded on SIGHUP")
+
+	ctx     context.Context
+	client  *http.Client
+	store   blobstore.Store
+	workers *workerPool
+	flight  drainer
 )
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	flag.Parse()
+	mustLoadConfig(*configPath)
 
-	ctx = cloud.NewContext(projectID, &http.Client{
+	ctx = cloud.NewContext(currentConfig().ProjectID, &http.Client{
 		Transport: google.NewComputeEngineConfig("").NewTransport(),
 	})
 
-	config, err := google.NewServiceAccountJSONConfig(*account, "https://www.googleapis.com/auth/userinfo.email")
+	var err error
+	store, err = blobstore.Open(currentConfig().Storage.Kind, ctx, currentConfig().Storage.Dir)
 	if err != nil {
 		log.Fatal(err)
 	}
-	client = &http.Client{Transport: config.NewTransport()}
 
-	http.HandleFunc("/healthcheck", func(http.ResponseWriter, *http.Request) {})
+	client = http.DefaultClient
+	if *account != "" {
+		config, err := google.NewServiceAccountJSONConfig(*account, "https://www.googleapis.com/auth/userinfo.email")
+		if err != nil {
+			log.Fatal(err)
+		}
+		client = &http.Client{Transport: config.NewTransport()}
+	}
+
+	workers = newWorkerPool(&currentConfig().Workers)
+	newGauge("abelana_queue_depth", "Images waiting for a worker.", func() float64 {
+		return float64(len(workers.jobs))
+	})
+	newGauge("abelana_workers_busy", "Workers processing an image.", func() float64 {
+		return float64(atomic.LoadInt32(&workers.active))
+	})
+
+	http.HandleFunc("/healthcheck", healthHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/delete", deleteHandler)
+	http.HandleFunc("/img/", proxyHandler)
 	http.HandleFunc("/", notificationHandler)
-	log.Println("server about to start listening on", listenAddress)
-	err = http.ListenAndServe(listenAddress, nil)
+	log.Println("server about to start listening on", *listen)
+	err = serveUntilTerm(*listen, *certFile, *keyFile, nil, &flight)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -79,93 +92,296 @@ func notificationHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	rl := newRequestLog(r, bucket, name)
 	token := r.Header.Get("Authorization")
 	if ok, err := authorized(token); !ok {
 		if err != nil {
-			log.Printf("authorize: %v", err)
+			rl.Errorf("authorize: %v", err)
 		}
 		http.Error(w, "you're not authorized", http.StatusForbidden)
 		return
 	}
+	if bucket != currentConfig().InputBucket {
+		// The renditions are named after the photo alone, they'd be those of someone else's.
+		http.Error(w, "not the input bucket", http.StatusForbidden)
+		return
+	}
 
+	if !flight.begin() {
+		busy(w, "shutting down")
+		return
+	}
+	defer flight.end()
+
+	done := make(chan bool)
+	if !workers.submit(func() {
+		defer close(done)
+		handleImage(w, rl, bucket, name, token)
+	}) {
+		busy(w, "too many images in the queue")
+		return
+	}
+	<-done
+}
+
+// handleImage processes an image and tells endpoints about it, it runs on the worker pool.
+func handleImage(w http.ResponseWriter, rl *requestLog, bucket, name, token string) {
 	start := time.Now()
-	defer func() { log.Printf("done in %v", time.Since(start)) }()
+	defer processLatency.since("", start)
 
-	if err := processImage(bucket, name); err != nil {
+	info, err := processImage(rl, bucket, name, token)
+	if rerr, ok := err.(*rejectError); ok {
+		// Retrying won't help, tell endpoints and make sure the task isn't retried.
+		imagesFailed.add("rejected", 1)
+		rl.Done(start, rerr)
+		if err := notifyFailed(rl, name, token, rerr.reason); err != nil {
+			rl.Errorf("%v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, rerr.Error(), statusRejected)
+		return
+	}
+	if err != nil {
 		// TODO: should this remove uploaded images?
-		log.Println(err.Error())
+		imagesFailed.add("processing", 1)
+		rl.Done(start, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if err := notifyDone(name, token); err != nil {
-		log.Println(err.Error())
+	pushStart := time.Now()
+	if err := notifyDone(rl, name, token, info); err != nil {
+		imagesFailed.add("notify", 1)
+		rl.Done(start, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rl.hop("push", pushStart)
+	imagesProcessed.add("", 1)
+	rl.Done(start, nil)
+
+	// notice keeps the timings on its record of the upload.
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Trace string           `json:"trace"`
+		Hops  map[string]int64 `json:"hops"`
+	}{rl.trace, rl.timings()})
+}
+
+// healthHandler is our readiness check, we are ready while we aren't shutting down, there's room
+// in the queue and ImageMagick can encode what we've been configured to produce.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if flight.isDraining() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if cap(workers.jobs) > 0 && len(workers.jobs) >= cap(workers.jobs) {
+		http.Error(w, "queue full", http.StatusServiceUnavailable)
+		return
+	}
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+	for _, rend := range currentConfig().Renditions {
+		for _, f := range rend.Formats {
+			if len(wand.QueryFormats(f)) == 0 {
+				http.Error(w, "no ImageMagick support for "+f, http.StatusServiceUnavailable)
+				return
+			}
+		}
 	}
+	fmt.Fprintln(w, "ok")
 }
 
-func processImage(bucket, name string) error {
-	r, err := storage.NewReader(ctx, bucket, name)
+func processImage(rl *requestLog, bucket, name, token string) (photoInfo, error) {
+	cfg := currentConfig()
+
+	readStart := time.Now()
+	r, err := store.Get(bucket, name)
 	if err != nil {
-		return fmt.Errorf("storage reader: %v", err)
+		return photoInfo{}, fmt.Errorf("storage reader: %v", err)
 	}
-	img, err := ioutil.ReadAll(r)
+	img, err := readLimited(r, &cfg.Limits)
 	r.Close()
+	gcsReadLatency.since("", readStart)
+	rl.hop("read", readStart)
+	bytesIn.add("", float64(len(img)))
 	if err != nil {
-		return fmt.Errorf("read image: %v", err)
+		if _, ok := err.(*rejectError); ok {
+			return photoInfo{}, err
+		}
+		return photoInfo{}, fmt.Errorf("read image: %v", err)
+	}
+	if err := checkImage(img, &cfg.Limits); err != nil {
+		return photoInfo{}, err
 	}
 
+	decodeStart := time.Now()
 	wand := imagick.NewMagickWand()
-	defer wand.Destroy()
+	defer func() { wand.Destroy() }()
 
-	wand.ReadImageBlob(img)
-	if err := wand.SetImageFormat("WEBP"); err != nil {
-		return fmt.Errorf("set WEBP format: %v", err)
+	if err := wand.ReadImageBlob(img); err != nil {
+		return photoInfo{}, reject("decode: %v", err)
+	}
+	wand.SetFirstIterator()
+	rl.Infof("read %d bytes, %s %dx%d", len(img), wand.GetImageFormat(), wand.GetImageWidth(), wand.GetImageHeight())
+	info := readInfo(wand)
+	if wand, info.Animated, err = coalesce(rl, wand, &cfg.Animation, cfg.Limits.MaxPixels); err != nil {
+		return info, err
+	}
+	if err := eachFrame(wand, func() error {
+		stripPrivate(wand)
+		return autoOrient(wand)
+	}); err != nil {
+		return info, err
 	}
 	wand.SetGravity(imagick.GRAVITY_CENTER)
+	if info.Color, info.BlurHash, err = preview(wand); err != nil {
+		// The photo is still fine without placeholders.
+		rl.Errorf("preview: %v", err)
+	}
+	if h, err := dHash(wand); err != nil {
+		// Nor without a hash, it just won't be checked for duplicates.
+		rl.Errorf("dhash: %v", err)
+	} else {
+		info.PHash = fmt.Sprintf("%016x", h)
+	}
+	rl.hop("decode", decodeStart)
+
+	m, err := newMark(rl, cfg, name, token)
+	if err != nil {
+		// Better a rendition without the watermark than none at all.
+		rl.Errorf("watermark: %v", err)
+	}
+	defer m.destroy()
+
+	renderStart := time.Now()
+	defer rl.hop("render", renderStart)
+
+	// sem bounds the number of renditions we encode at once.
+	n := cfg.Workers.Renditions
+	if n <= 0 || n > len(cfg.Renditions) {
+		n = len(cfg.Renditions)
+	}
+	sem := make(chan bool, n)
 
-	errc := make(chan error, len(sizes))
-	for suffix, size := range sizes {
-		go func(wand *imagick.MagickWand, suffix string, x, y uint) {
+	// Every goroutine gets copies of the pixels and of the watermark, wands aren't safe to share.
+	errc := make(chan error, len(cfg.Renditions))
+	for i := range cfg.Renditions {
+		rend := &cfg.Renditions[i]
+		var rm *mark
+		if rend.Watermark {
+			rm = m.clone()
+		}
+		sem <- true
+		go func(wand *imagick.MagickWand, rend *Rendition, m *mark) {
 			errc <- func() error {
+				defer func() { <-sem }()
 				defer wand.Destroy()
+				defer m.destroy()
 
-				/* Fix later, crop the images to be square.
-				if err := wand.CropImage(x, y, 0, 0); err != nil {
-					return fmt.Errorf("crop: %v", err)
+				encodeStart := time.Now()
+				if err := resizeFrames(wand, rend); err != nil {
+					return fmt.Errorf("resize %s: %v", rend.Suffix, err)
 				}
-				*/
-				if err := wand.AdaptiveResizeImage(size.x, size.y); err != nil {
-					return fmt.Errorf("resize: %v", err)
+				if rend.Strip {
+					if err := eachFrame(wand, wand.StripImage); err != nil {
+						return fmt.Errorf("strip: %v", err)
+					}
 				}
-
-				target := name
-				if sep := strings.LastIndex(target, "."); sep >= 0 {
-					target = target[:sep]
+				if m != nil {
+					if err := eachFrame(wand, func() error {
+						return applyMark(wand, m, &cfg.Watermark)
+					}); err != nil {
+						return fmt.Errorf("watermark %s: %v", rend.Suffix, err)
+					}
 				}
-				target = fmt.Sprintf("%s_%s.webp", target, suffix)
 
-				w := storage.NewWriter(ctx, outputBucket, target, nil)
-				if _, err := w.Write(wand.GetImageBlob()); err != nil {
-					return fmt.Errorf("new writer: %v", err)
+				base := name
+				if sep := strings.LastIndex(base, "."); sep >= 0 {
+					base = base[:sep]
 				}
-				if err := w.Close(); err != nil {
-					return fmt.Errorf("close object writer: %v", err)
-				}
-				if _, err := w.Object(); err != nil {
-					return fmt.Errorf("write op: %v", err)
+				// The pixels are resized once, each format is encoded from a copy so the settings
+				// of one don't leak into the next.
+				for _, f := range rend.Formats {
+					blob, err := encode(wand, f, cfg.quality(rend, f))
+					if err != nil {
+						return err
+					}
+					encodeLatency.since(rend.Suffix, encodeStart)
+					target := rend.objectName(base, f)
+
+					writeStart := time.Now()
+					err = store.Put(cfg.OutputBucket, target, "image/"+extOf(f), bytes.NewReader(blob))
+					gcsWriteLatency.since("", writeStart)
+					if err != nil {
+						return fmt.Errorf("write %s: %v", target, err)
+					}
+					bytesOut.add("", float64(len(blob)))
+					encodeStart = time.Now()
 				}
 				return nil
 			}()
-		}(wand.Clone(), suffix, size.x, size.y)
+		}(wand.Clone(), rend, rm)
 	}
 
-	for _ = range sizes {
-		if err := <-errc; err != nil {
-			return err
+	// Wait for all of them, the deferred destroys mustn't run under a rendition still going.
+	var first error
+	for _ = range cfg.Renditions {
+		if err := <-errc; err != nil && first == nil {
+			first = err
 		}
 	}
-	return nil
+	if first != nil {
+		return info, first
+	}
+	info.Formats = make(map[string][]string)
+	for _, rend := range cfg.Renditions {
+		info.Renditions = append(info.Renditions, rend.Suffix)
+		for _, f := range rend.Formats {
+			info.Formats[rend.Suffix] = append(info.Formats[rend.Suffix], extOf(f))
+		}
+	}
+
+	// The on-demand renditions are of the previous upload, if there was one.
+	base := name
+	if sep := strings.LastIndex(base, "."); sep >= 0 {
+		base = base[:sep]
+	}
+	if err := purgeDerived(cfg.OutputBucket, base); err != nil {
+		rl.Errorf("purge on-demand renditions: %v", err)
+	}
+	return info, nil
+}
+
+// encode returns the image in format, at quality unless it is 0.  Animations stay animated in
+// the animatedFormats, the others get the current frame.
+func encode(wand *imagick.MagickWand, format string, quality uint) ([]byte, error) {
+	animated := wand.GetNumberImages() > 1 && animatedFormats[format]
+	var w *imagick.MagickWand
+	if animated {
+		w = wand.Clone()
+	} else {
+		w = wand.GetImage()
+	}
+	defer w.Destroy()
+	if err := eachFrame(w, func() error {
+		if err := w.SetImageFormat(format); err != nil {
+			return fmt.Errorf("set %s format: %v", format, err)
+		}
+		if quality > 0 {
+			if err := w.SetImageCompressionQuality(quality); err != nil {
+				return fmt.Errorf("set quality: %v", err)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if animated {
+		return w.GetImagesBlob(), nil
+	}
+	return w.GetImageBlob(), nil
 }
 
 func authorized(token string) (ok bool, err error) {
@@ -179,25 +395,68 @@ func authorized(token string) (ok bool, err error) {
 	if err != nil {
 		return false, err
 	}
+	if u := currentConfig().TokenInfoURL; u != "" {
+		svc.BasePath = u
+	}
 	tok, err := svc.Tokeninfo().Access_token(token).Do()
-	return err == nil && tok.Email == authEmail, err
+	return err == nil && tok.Email == currentConfig().AuthEmail, err
 }
 
-func notifyDone(name, token string) (err error) {
+func notifyDone(rl *requestLog, name, token string, info photoInfo) (err error) {
 	// drop the file extension
-	name = name[:strings.LastIndex(name, ".")]
-	req, err := http.NewRequest("POST", pushURL+name, &bytes.Buffer{})
+	if sep := strings.LastIndex(name, "."); sep >= 0 {
+		name = name[:sep]
+	}
+	body, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", currentConfig().PushURL+name, bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Authorization", token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(traceHeader, rl.trace)
 
 	res, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("photo push: %v", err)
 	}
+	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
 		return fmt.Errorf("photo push status: %v", res.Status)
 	}
 	return nil
 }
+
+// notifyFailed tells endpoints that the photo could not be processed and why.
+func notifyFailed(rl *requestLog, name, token, reason string) error {
+	// drop the file extension
+	if sep := strings.LastIndex(name, "."); sep >= 0 {
+		name = name[:sep]
+	}
+	body, err := json.Marshal(struct {
+		Reason string `json:"reason"`
+	}{reason})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", currentConfig().PushURL+name+"/failed", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(traceHeader, rl.trace)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("photo failed push: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("photo failed push status: %v", res.Status)
+	}
+	return nil
+}
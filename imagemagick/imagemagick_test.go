@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestEncode(t *testing.T) {
+	all := []string{"JPEG", "PNG", "GIF", "WEBP"}
+	for _, format := range all {
+		wand := readFixture(t, "landscape.png")
+		blob, err := encode(wand, format, 80)
+		wand.Destroy()
+		if err != nil {
+			t.Errorf("%s: %v", format, err)
+			continue
+		}
+		// The renditions are named after the format, clients trust the extension.
+		if got := sniff(blob, all); got != format {
+			head := blob
+			if len(head) > 12 {
+				head = head[:12]
+			}
+			t.Errorf("encoded as %s, the bytes are %q (%q)", format, got, head)
+		}
+	}
+}
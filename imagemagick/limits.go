@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/gographics/imagick/imagick"
+)
+
+// Defaults for the input limits, used when the config leaves them out.
+const (
+	defaultMaxBytes  = 20 << 20 // 20MB
+	defaultMaxPixels = 50e6     // 50 megapixels, across all frames
+)
+
+var defaultInputFormats = []string{"JPEG", "PNG", "GIF", "WEBP"}
+
+// signatures are the magic bytes of the formats we can accept, by ImageMagick format name.  A zero
+// byte matches any byte, the RIFF chunk size of a WebP.
+var signatures = map[string][][]byte{
+	"JPEG": {[]byte("\xff\xd8\xff")},
+	"PNG":  {[]byte("\x89PNG\r\n\x1a\n")},
+	"GIF":  {[]byte("GIF87a"), []byte("GIF89a")},
+	"WEBP": {[]byte("RIFF\x00\x00\x00\x00WEBP")},
+}
+
+// sniff returns the format of img going by its first bytes, "" if it isn't one of formats.
+func sniff(img []byte, formats []string) string {
+	for _, f := range formats {
+	sig:
+		for _, s := range signatures[f] {
+			if len(img) < len(s) {
+				continue
+			}
+			for i, b := range s {
+				if b != 0 && img[i] != b {
+					continue sig
+				}
+			}
+			return f
+		}
+	}
+	return ""
+}
+
+// Limits protects the server from uploads that are too big to handle or aren't images at all.
+type Limits struct {
+	MaxBytes     int64    // largest original we read
+	MaxPixels    uint64   // largest width x height x frames we decode
+	InputFormats []string // ImageMagick format names we accept
+
+	// ImageMagick resource limits in bytes, 0 leaves the ImageMagick default.
+	Memory int64
+	Map    int64
+	Disk   int64
+}
+
+func (l *Limits) validate() error {
+	if l.MaxBytes < 0 {
+		return fmt.Errorf("negative MaxBytes")
+	}
+	if l.MaxBytes == 0 {
+		l.MaxBytes = defaultMaxBytes
+	}
+	if l.MaxPixels == 0 {
+		l.MaxPixels = defaultMaxPixels
+	}
+	if len(l.InputFormats) == 0 {
+		l.InputFormats = defaultInputFormats
+	}
+	for i, f := range l.InputFormats {
+		l.InputFormats[i] = strings.ToUpper(f)
+		if signatures[l.InputFormats[i]] == nil {
+			return fmt.Errorf("no signature to recognise %s uploads by", f)
+		}
+	}
+	return nil
+}
+
+// rejectError is returned for uploads we will never be able to process, they must not be retried.
+type rejectError struct {
+	reason string
+}
+
+func (e *rejectError) Error() string {
+	return "rejected: " + e.reason
+}
+
+func reject(format string, args ...interface{}) error {
+	return &rejectError{fmt.Sprintf(format, args...)}
+}
+
+// readLimited reads r, rejecting anything larger than the limit.
+func readLimited(r io.Reader, l *Limits) ([]byte, error) {
+	img, err := ioutil.ReadAll(io.LimitReader(r, l.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(img)) > l.MaxBytes {
+		return nil, reject("larger than %d bytes", l.MaxBytes)
+	}
+	return img, nil
+}
+
+// checkImage looks at the headers of img, without decoding the pixels, and rejects images in a
+// format we don't accept or with more pixels than we are willing to decode.  The format is
+// sniffed before ImageMagick sees the bytes, so uploads only ever reach the coders we accept.
+func checkImage(img []byte, l *Limits) error {
+	sniffed := sniff(img, l.InputFormats)
+	if sniffed == "" {
+		return reject("not one of %s", strings.Join(l.InputFormats, ", "))
+	}
+
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+
+	if err := wand.PingImageBlob(img); err != nil {
+		return reject("unreadable image: %v", err)
+	}
+	if format := strings.ToUpper(wand.GetImageFormat()); format != sniffed {
+		return reject("format %q doesn't match its %s signature", format, sniffed)
+	}
+
+	var pixels uint64
+	wand.ResetIterator()
+	for wand.NextImage() {
+		pixels += uint64(wand.GetImageWidth()) * uint64(wand.GetImageHeight())
+	}
+	if pixels == 0 {
+		return reject("empty image")
+	}
+	if pixels > l.MaxPixels {
+		return reject("%d pixels, more than %d", pixels, l.MaxPixels)
+	}
+	return nil
+}
+
+// setResourceLimits applies the ImageMagick resource limits, they are process wide.
+func setResourceLimits(l *Limits) {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+
+	for _, r := range []struct {
+		name  string
+		rtype imagick.ResourceType
+		limit int64
+	}{
+		{"memory", imagick.RESOURCE_MEMORY, l.Memory},
+		{"map", imagick.RESOURCE_MAP, l.Map},
+		{"disk", imagick.RESOURCE_DISK, l.Disk},
+		{"area", imagick.RESOURCE_AREA, int64(l.MaxPixels)},
+	} {
+		if r.limit <= 0 {
+			continue
+		}
+		if err := wand.SetResourceLimit(r.rtype, r.limit); err != nil {
+			log.Printf("set %s resource limit: %v", r.name, err)
+		}
+	}
+}
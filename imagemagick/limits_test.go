@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestSniff(t *testing.T) {
+	all := []string{"JPEG", "PNG", "GIF", "WEBP"}
+	for _, tt := range []struct {
+		img     string
+		formats []string
+		want    string
+	}{
+		{"\xff\xd8\xff\xe0\x00\x10JFIF", all, "JPEG"},
+		{"\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR", all, "PNG"},
+		{"GIF87a\x01\x00", all, "GIF"},
+		{"GIF89a\x01\x00", all, "GIF"},
+		{"RIFF\x24\x10\x00\x00WEBPVP8 ", all, "WEBP"},
+		{"RIFF\x24\x10\x00\x00AVI LIST", all, ""},
+		{"\x89PNG\r\n\x1a\n", []string{"JPEG"}, ""}, // not accepted
+		{"push graphic-context\nviewbox 0 0 640 480", all, ""},
+		{"%!PS-Adobe-3.0", all, ""},
+		{"\xff\xd8", all, ""}, // too short
+		{"", all, ""},
+	} {
+		if got := sniff([]byte(tt.img), tt.formats); got != tt.want {
+			t.Errorf("sniff(%q, %v) = %q, want %q", tt.img, tt.formats, got, tt.want)
+		}
+	}
+}
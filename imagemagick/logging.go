@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// traceHeader carries the id notice gave the upload when it was first notified, it is passed on to
+// endpoints so the logs of every service can be matched.
+const traceHeader = "X-Trace-Id"
+
+// Logs are written one JSON object per line.  The standard logger is redirected through
+// jsonWriter, so everything the process logs can be parsed the same way.
+
+var logOut = struct {
+	sync.Mutex
+	w io.Writer
+}{w: os.Stderr}
+
+func writeEntry(e map[string]interface{}) {
+	e["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	b, err := json.Marshal(e)
+	if err != nil {
+		b = []byte(fmt.Sprintf(`{"severity":"ERROR","message":%q}`, err.Error()))
+	}
+	logOut.Lock()
+	logOut.w.Write(append(b, '\n'))
+	logOut.Unlock()
+}
+
+// jsonWriter wraps the lines of the standard logger.
+type jsonWriter struct{}
+
+func (jsonWriter) Write(p []byte) (int, error) {
+	writeEntry(map[string]interface{}{
+		"severity": "INFO",
+		"message":  strings.TrimSuffix(string(p), "\n"),
+	})
+	return len(p), nil
+}
+
+func init() {
+	log.SetFlags(0)
+	log.SetOutput(jsonWriter{})
+}
+
+// requestLog logs on behalf of a single image, every entry carries its bucket, name and trace id.
+// It also times the steps of the processing.
+type requestLog struct {
+	trace  string
+	fields map[string]interface{}
+
+	mu   sync.Mutex
+	hops map[string]int64 // milliseconds spent in each step
+}
+
+func newRequestLog(r *http.Request, bucket, name string) *requestLog {
+	trace := r.Header.Get(traceHeader)
+	return &requestLog{
+		trace: trace,
+		fields: map[string]interface{}{
+			"bucket": bucket,
+			"name":   name,
+			"trace":  trace,
+		},
+		hops: make(map[string]int64),
+	}
+}
+
+// hop records the time spent in a step since start.
+func (l *requestLog) hop(step string, start time.Time) {
+	l.mu.Lock()
+	l.hops[step] += int64(time.Since(start) / time.Millisecond)
+	l.mu.Unlock()
+}
+
+// timings returns the time spent in each step so far.
+func (l *requestLog) timings() map[string]int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t := make(map[string]int64, len(l.hops))
+	for k, v := range l.hops {
+		t[k] = v
+	}
+	return t
+}
+
+func (l *requestLog) log(severity, format string, args []interface{}, extra map[string]interface{}) {
+	e := map[string]interface{}{
+		"severity": severity,
+		"message":  fmt.Sprintf(format, args...),
+	}
+	for k, v := range l.fields {
+		e[k] = v
+	}
+	for k, v := range extra {
+		e[k] = v
+	}
+	writeEntry(e)
+}
+
+func (l *requestLog) Infof(format string, args ...interface{}) {
+	l.log("INFO", format, args, nil)
+}
+
+func (l *requestLog) Errorf(format string, args ...interface{}) {
+	l.log("ERROR", format, args, nil)
+}
+
+// Done logs the end of the processing with how long it took.
+func (l *requestLog) Done(start time.Time, err error) {
+	extra := map[string]interface{}{"latency": time.Since(start).Seconds(), "hops": l.timings()}
+	if err != nil {
+		l.log("ERROR", "failed: %v", []interface{}{err}, extra)
+		return
+	}
+	l.log("INFO", "done", nil, extra)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gographics/imagick/imagick"
+)
+
+// photoInfo is what we learn about a photo while processing it, it is sent to endpoints as the
+// JSON body of the photopush call.
+type photoInfo struct {
+	Taken int64  `json:"taken,omitempty"` // capture time, seconds since the epoch
+	Make  string `json:"make,omitempty"`  // camera maker
+	Model string `json:"model,omitempty"` // camera model
+
+	Color    string `json:"color,omitempty"`    // dominant colour, #rrggbb
+	BlurHash string `json:"blurhash,omitempty"` // placeholder, see preview.go
+	PHash    string `json:"phash,omitempty"`    // dHash of the original, 16 hex digits
+	Animated bool   `json:"animated,omitempty"` // the renditions in animatedFormats animate
+
+	Renditions []string            `json:"renditions,omitempty"` // suffixes of the renditions written
+	Formats    map[string][]string `json:"formats,omitempty"`    // their extensions, by suffix
+}
+
+// exifTime is the layout of the EXIF date fields, they carry no time zone so we read them as UTC.
+const exifTime = "2006:01:02 15:04:05"
+
+// privateProfiles are removed from every rendition, they hold the GPS position, serial numbers
+// of the camera and lens, the owner's name and the like.  Whatever we want to keep from them is
+// extracted by readInfo first.
+var privateProfiles = []string{"exif", "xmp", "iptc", "8bim"}
+
+// readInfo extracts the metadata we consider safe to share.
+func readInfo(wand *imagick.MagickWand) photoInfo {
+	var info photoInfo
+	for _, p := range []string{"exif:DateTimeOriginal", "exif:DateTimeDigitized", "exif:DateTime"} {
+		if t, err := time.Parse(exifTime, strings.TrimSpace(wand.GetImageProperty(p))); err == nil {
+			info.Taken = t.Unix()
+			break
+		}
+	}
+	info.Make = strings.TrimSpace(wand.GetImageProperty("exif:Make"))
+	info.Model = strings.TrimSpace(wand.GetImageProperty("exif:Model"))
+	return info
+}
+
+// stripPrivate removes the metadata profiles, colour profiles are kept.
+func stripPrivate(wand *imagick.MagickWand) {
+	for _, p := range privateProfiles {
+		wand.RemoveImageProfile(p)
+	}
+	for _, p := range wand.GetImageProperties("exif:*") {
+		wand.DeleteImageProperty(p)
+	}
+}
+
+// autoOrient rotates the pixels as the EXIF orientation says, so renditions without the tag are
+// displayed the right way up.
+func autoOrient(wand *imagick.MagickWand) error {
+	var err error
+	switch wand.GetImageOrientation() {
+	case imagick.ORIENTATION_TOP_RIGHT:
+		err = wand.FlopImage()
+	case imagick.ORIENTATION_BOTTOM_RIGHT:
+		err = rotate(wand, 180)
+	case imagick.ORIENTATION_BOTTOM_LEFT:
+		err = wand.FlipImage()
+	case imagick.ORIENTATION_LEFT_TOP:
+		err = wand.TransposeImage()
+	case imagick.ORIENTATION_RIGHT_TOP:
+		err = rotate(wand, 90)
+	case imagick.ORIENTATION_RIGHT_BOTTOM:
+		err = wand.TransverseImage()
+	case imagick.ORIENTATION_LEFT_BOTTOM:
+		err = rotate(wand, 270)
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("auto orient: %v", err)
+	}
+	return wand.SetImageOrientation(imagick.ORIENTATION_TOP_LEFT)
+}
+
+func rotate(wand *imagick.MagickWand, degrees float64) error {
+	bg := imagick.NewPixelWand()
+	defer bg.Destroy()
+	bg.SetColor("none")
+	return wand.RotateImage(bg, degrees)
+}
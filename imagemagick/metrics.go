@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A tiny implementation of the Prometheus text exposition format, enough for counters, gauges
+// and histograms with at most one label.
+
+var (
+	imagesProcessed = newCounter("abelana_images_processed_total", "Images processed successfully.", "")
+	imagesFailed    = newCounter("abelana_images_failed_total", "Images that failed, by reason.", "reason")
+	bytesIn         = newCounter("abelana_bytes_in_total", "Bytes of originals read.", "")
+	bytesOut        = newCounter("abelana_bytes_out_total", "Bytes of renditions written.", "")
+	proxyRequests   = newCounter("abelana_proxy_requests_total", "On-demand renditions asked for, by outcome.", "cache")
+
+	processLatency  = newHistogram("abelana_image_process_seconds", "Time to process an image, all renditions included.", "", latencyBuckets)
+	encodeLatency   = newHistogram("abelana_rendition_encode_seconds", "Time to resize and encode a rendition.", "suffix", latencyBuckets)
+	gcsReadLatency  = newHistogram("abelana_gcs_read_seconds", "Time to read an original from GCS.", "", latencyBuckets)
+	gcsWriteLatency = newHistogram("abelana_gcs_write_seconds", "Time to write a rendition to GCS.", "", latencyBuckets)
+
+	latencyBuckets = []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+)
+
+// collector is anything that can write itself in the exposition format.
+type collector interface {
+	write(w io.Writer)
+}
+
+var registry struct {
+	sync.Mutex
+	cs []collector
+}
+
+func register(c collector) {
+	registry.Lock()
+	registry.cs = append(registry.cs, c)
+	registry.Unlock()
+}
+
+// metricsHandler serves all the registered metrics.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	registry.Lock()
+	defer registry.Unlock()
+	for _, c := range registry.cs {
+		c.write(w)
+	}
+}
+
+// series formats the name of a series with its label, if any.
+func series(name, label, value string) string {
+	if label == "" {
+		return name
+	}
+	return fmt.Sprintf("%s{%s=%q}", name, label, value)
+}
+
+// sortedKeys keeps the output stable between scrapes.
+func sortedKeys(m map[string]bool) []string {
+	var ks []string
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
+
+type counter struct {
+	sync.Mutex
+	name, help, label string
+	values            map[string]float64
+}
+
+func newCounter(name, help, label string) *counter {
+	c := &counter{name: name, help: help, label: label, values: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+// add increments the series for the label value, which is ignored for counters without a label.
+func (c *counter) add(value string, v float64) {
+	c.Lock()
+	c.values[value] += v
+	c.Unlock()
+}
+
+func (c *counter) write(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make(map[string]bool)
+	for k := range c.values {
+		keys[k] = true
+	}
+	if c.label == "" {
+		fmt.Fprintf(w, "%s %v\n", c.name, c.values[""])
+		return
+	}
+	for _, k := range sortedKeys(keys) {
+		fmt.Fprintf(w, "%s %v\n", series(c.name, c.label, k), c.values[k])
+	}
+}
+
+type gauge struct {
+	name, help string
+	f          func() float64
+}
+
+// newGauge registers a gauge whose value is computed by f at scrape time.
+func newGauge(name, help string, f func() float64) *gauge {
+	g := &gauge{name, help, f}
+	register(g)
+	return g
+}
+
+func (g *gauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", g.name, g.help, g.name, g.name, g.f())
+}
+
+type histogram struct {
+	sync.Mutex
+	name, help, label string
+	buckets           []float64
+	counts            map[string][]uint64 // per label value, one per bucket, cumulative on output
+	sums              map[string]float64
+	totals            map[string]uint64
+}
+
+func newHistogram(name, help, label string, buckets []float64) *histogram {
+	h := &histogram{
+		name:    name,
+		help:    help,
+		label:   label,
+		buckets: buckets,
+		counts:  make(map[string][]uint64),
+		sums:    make(map[string]float64),
+		totals:  make(map[string]uint64),
+	}
+	register(h)
+	return h
+}
+
+func (h *histogram) observe(value string, v float64) {
+	h.Lock()
+	defer h.Unlock()
+	cs, ok := h.counts[value]
+	if !ok {
+		cs = make([]uint64, len(h.buckets))
+		h.counts[value] = cs
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			cs[i]++
+			break
+		}
+	}
+	h.sums[value] += v
+	h.totals[value]++
+}
+
+// since observes the time elapsed since start, in seconds.
+func (h *histogram) since(value string, start time.Time) {
+	h.observe(value, time.Since(start).Seconds())
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make(map[string]bool)
+	for k := range h.counts {
+		keys[k] = true
+	}
+	for _, k := range sortedKeys(keys) {
+		labels := ""
+		if h.label != "" {
+			labels = fmt.Sprintf("%s=%q,", h.label, k)
+		}
+		var cum uint64
+		for i, b := range h.buckets {
+			cum += h.counts[k][i]
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%v\"} %d\n", h.name, labels, b, cum)
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, labels, h.totals[k])
+		fmt.Fprintf(w, "%s %v\n", series(h.name+"_sum", h.label, k), h.sums[k])
+		fmt.Fprintf(w, "%s %d\n", series(h.name+"_count", h.label, k), h.totals[k])
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gographics/imagick/imagick"
+)
+
+// dHash returns the difference hash of the image: a 9x8 grayscale copy where each bit tells
+// whether a pixel is brighter than its right neighbour.  Resized, recompressed or slightly edited
+// copies of a photo have hashes a few bits apart, endpoints compares them to find duplicates.
+func dHash(wand *imagick.MagickWand) (uint64, error) {
+	probe := wand.GetImage()
+	defer probe.Destroy()
+
+	if err := probe.ScaleImage(9, 8); err != nil {
+		return 0, err
+	}
+	if err := probe.TransformImageColorspace(imagick.COLORSPACE_GRAY); err != nil {
+		return 0, err
+	}
+	if err := probe.SetImageDepth(8); err != nil {
+		return 0, err
+	}
+	// Raw GRAY is a byte a pixel, row after row.
+	if err := probe.SetImageFormat("GRAY"); err != nil {
+		return 0, err
+	}
+	px := probe.GetImageBlob()
+	if len(px) != 9*8 {
+		return 0, fmt.Errorf("got %d bytes of pixels for 9x8", len(px))
+	}
+
+	var h uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			h <<= 1
+			if px[y*9+x] > px[y*9+x+1] {
+				h |= 1
+			}
+		}
+	}
+	return h, nil
+}
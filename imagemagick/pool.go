@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Workers sizes the processing pool.  Changes only take effect on restart, except for
+// Renditions which is read for every image.
+type Workers struct {
+	Count      int // images processed at once, defaults to the number of CPUs
+	Queue      int // images waiting for a worker before we start replying 503
+	Renditions int // renditions of an image encoded at once, 0 means all of them
+	RetryAfter int // seconds, sent along with the 503s
+}
+
+func (w *Workers) validate() {
+	if w.Count <= 0 {
+		w.Count = runtime.NumCPU()
+	}
+	if w.Queue < 0 {
+		w.Queue = 0
+	}
+	if w.RetryAfter <= 0 {
+		w.RetryAfter = 30
+	}
+}
+
+// workerPool runs a fixed number of jobs at once, with a bounded queue in front of them.
+type workerPool struct {
+	jobs   chan func()
+	active int32 // jobs running, updated atomically
+}
+
+func newWorkerPool(w *Workers) *workerPool {
+	p := &workerPool{jobs: make(chan func(), w.Queue)}
+	for i := 0; i < w.Count; i++ {
+		go func() {
+			for job := range p.jobs {
+				atomic.AddInt32(&p.active, 1)
+				job()
+				atomic.AddInt32(&p.active, -1)
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues job, it reports false if the queue is full.
+func (p *workerPool) submit(job func()) bool {
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// busy replies 503 telling the task queue when to come back.
+func busy(w http.ResponseWriter, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(currentConfig().Workers.RetryAfter))
+	http.Error(w, msg, http.StatusServiceUnavailable)
+}
+
+// drainer keeps track of the requests in flight so we can wait for them on shutdown.
+type drainer struct {
+	mu       sync.Mutex
+	draining bool
+	wg       sync.WaitGroup
+}
+
+// begin reports whether a new request may start, if it does end must be called when it's done.
+func (d *drainer) begin() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return false
+	}
+	d.wg.Add(1)
+	return true
+}
+
+func (d *drainer) end() {
+	d.wg.Done()
+}
+
+func (d *drainer) isDraining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining
+}
+
+// drain refuses new requests and waits for the ones in flight.
+func (d *drainer) drain() {
+	d.mu.Lock()
+	d.draining = true
+	d.mu.Unlock()
+	d.wg.Wait()
+}
+
+// serveUntilTerm serves until SIGTERM or SIGINT, then stops accepting connections and exits once
+// the images in flight are done.  It serves HTTPS when given a certificate and key.
+func serveUntilTerm(addr, certFile, keyFile string, h http.Handler, d *drainer) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		l = tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	stopping, done := make(chan bool), make(chan bool)
+	go func() {
+		sig := <-term
+		log.Printf("%v: draining", sig)
+		close(stopping)
+		l.Close()
+		d.drain()
+		close(done)
+	}()
+
+	err = http.Serve(l, h)
+	select {
+	case <-stopping:
+		// Serve returns as soon as the listener is closed, wait for the images in flight.
+		<-done
+		log.Println("drained, bye")
+		return nil
+	default:
+		return err
+	}
+}
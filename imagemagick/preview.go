@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/gographics/imagick/imagick"
+)
+
+// Placeholders the clients paint while the renditions download: the dominant colour of the photo
+// and its BlurHash, see https://blurha.sh.  Both are computed from a small copy of the original.
+
+const (
+	previewSize  = 32 // longest side of the copy we compute the previews from
+	blurHashLong = 4  // BlurHash components along the longest side
+	blurHashWide = 3  // and along the other one
+)
+
+// preview returns the dominant colour, as #rrggbb, and the BlurHash of the image.
+func preview(wand *imagick.MagickWand) (string, string, error) {
+	probe := wand.GetImage()
+	defer probe.Destroy()
+
+	w, h := scaleTo(probe.GetImageWidth(), probe.GetImageHeight(), previewSize, previewSize, false)
+	if err := probe.ScaleImage(w, h); err != nil {
+		return "", "", err
+	}
+	if err := probe.TransformImageColorspace(imagick.COLORSPACE_SRGB); err != nil {
+		return "", "", err
+	}
+	if err := probe.SetImageDepth(8); err != nil {
+		return "", "", err
+	}
+	// Raw RGB is three bytes a pixel, row after row.
+	if err := probe.SetImageFormat("RGB"); err != nil {
+		return "", "", err
+	}
+	rgb := probe.GetImageBlob()
+	if len(rgb) != int(w*h*3) {
+		return "", "", fmt.Errorf("got %d bytes of pixels for %dx%d", len(rgb), w, h)
+	}
+
+	cx, cy := blurHashLong, blurHashWide
+	if h > w {
+		cx, cy = cy, cx
+	}
+	return dominantColour(rgb), blurHash(rgb, int(w), int(h), cx, cy), nil
+}
+
+// dominantColour returns the average of the most common colour, with 4 bits a channel so that
+// close shades count as one.
+func dominantColour(rgb []byte) string {
+	var count [4096]int
+	var sum [4096][3]int
+	best := 0
+	for i := 0; i+2 < len(rgb); i += 3 {
+		bin := int(rgb[i]>>4)<<8 | int(rgb[i+1]>>4)<<4 | int(rgb[i+2]>>4)
+		count[bin]++
+		sum[bin][0] += int(rgb[i])
+		sum[bin][1] += int(rgb[i+1])
+		sum[bin][2] += int(rgb[i+2])
+		if count[bin] > count[best] {
+			best = bin
+		}
+	}
+	n := count[best]
+	if n == 0 {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", sum[best][0]/n, sum[best][1]/n, sum[best][2]/n)
+}
+
+// blurHash encodes the w x h RGB pixels with cx x cy components.
+func blurHash(rgb []byte, w, h, cx, cy int) string {
+	factors := make([][3]float64, 0, cx*cy)
+	for j := 0; j < cy; j++ {
+		for i := 0; i < cx; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(w)) * math.Cos(math.Pi*float64(j*y)/float64(h))
+					p := rgb[(y*w+x)*3:]
+					f[0] += basis * srgbToLinear(p[0])
+					f[1] += basis * srgbToLinear(p[1])
+					f[2] += basis * srgbToLinear(p[2])
+				}
+			}
+			scale := norm / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	hash := encode83((cx-1)+(cy-1)*9, 1)
+	dc, ac := factors[0], factors[1:]
+	maxValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantised := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantised+1) / 166
+		hash += encode83(quantised, 1)
+	} else {
+		hash += encode83(0, 1)
+	}
+	hash += encode83(linearToSrgb(dc[0])<<16|linearToSrgb(dc[1])<<8|linearToSrgb(dc[2]), 4)
+	for _, f := range ac {
+		q := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		hash += encode83(q(f[0])*19*19+q(f[1])*19+q(f[2]), 2)
+	}
+	return hash
+}
+
+func srgbToLinear(b byte) float64 {
+	v := float64(b) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func encode83(v, length int) string {
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = base83[v%83]
+		v /= 83
+	}
+	return string(b)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gographics/imagick/imagick"
+
+	"github.com/GoogleCloudPlatform/abelana-gcp/imagemagick/blobstore"
+)
+
+// On-demand renditions, GET /img/userid.photoid?w=&h=&fit=&fmt=&exp=&sig=
+//
+// sig is the hex HMAC-SHA256, with Proxy.Key, of the photo id and the parameters each on their
+// own line: "userid.photoid\nw\nh\nfit\nfmt\nexp".  exp is when the URL expires, in seconds
+// since the epoch.  Endpoints signs the URLs for the viewers allowed to see the photo, so replies
+// are only cached privately.  Only the boxes in Proxy.Sizes can be asked for.
+// Renditions are kept next to the fixed ones, as userid.photoid_od-<w>x<h>-<fit>.<ext>, so they
+// are deleted along with them and are purged when the original is uploaded again.
+//
+// On-demand sizes are for the app's own screens, they are never the renditions shared outside it
+// and so never get the watermark.
+
+// derivedSuffix starts the suffix of the on-demand renditions.
+const derivedSuffix = "od-"
+
+// Defaults of the proxy, used when the config leaves them out.
+const defaultProxyMaxAge = 24 * 60 * 60
+
+var defaultProxyFormats = []string{"WEBP", "JPEG"}
+
+// Proxy configures the on-demand renditions, it is disabled without a Key.
+type Proxy struct {
+	InputBucket string   // where the originals are, defaults to the InputBucket of the config
+	Key         string   // the parameters are signed with it
+	Sizes       []string // the boxes that can be asked for, "480x800"
+	Formats     []string // ImageMagick format names, defaults to WEBP and JPEG
+	MaxAge      int      // seconds clients may cache a rendition, defaults to a day, never past its URL expiry
+
+	sizes map[string]bool
+}
+
+func (p *Proxy) validate() error {
+	if p.Key == "" {
+		return nil
+	}
+	if p.InputBucket == "" {
+		return fmt.Errorf("missing InputBucket")
+	}
+	p.sizes = make(map[string]bool)
+	for _, s := range p.Sizes {
+		if _, _, err := parseSize(s); err != nil {
+			return err
+		}
+		p.sizes[s] = true
+	}
+	if len(p.Formats) == 0 {
+		p.Formats = defaultProxyFormats
+	}
+	for i, f := range p.Formats {
+		p.Formats[i] = strings.ToUpper(f)
+	}
+	if p.MaxAge <= 0 {
+		p.MaxAge = defaultProxyMaxAge
+	}
+	return nil
+}
+
+// parseSize reads a WxH box.
+func parseSize(s string) (w, h uint, err error) {
+	d := strings.Split(s, "x")
+	if len(d) == 2 {
+		pw, errw := strconv.ParseUint(d[0], 10, 32)
+		ph, errh := strconv.ParseUint(d[1], 10, 32)
+		if errw == nil && errh == nil && pw > 0 && ph > 0 {
+			return uint(pw), uint(ph), nil
+		}
+	}
+	return 0, 0, fmt.Errorf("size %q isn't WxH", s)
+}
+
+// proxySign returns the signature of the parameters.
+func proxySign(key, photoID, w, h, fit, format, exp string) string {
+	m := hmac.New(sha256.New, []byte(key))
+	io.WriteString(m, strings.Join([]string{photoID, w, h, fit, format, exp}, "\n"))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// proxyHandler serves the on-demand renditions, rendering them on a miss.
+func proxyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := currentConfig()
+	p := &cfg.Proxy
+	if p.Key == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	photoID := strings.TrimPrefix(r.URL.Path, "/img/")
+	q := r.URL.Query()
+	ws, hs, fit, format := q.Get("w"), q.Get("h"), q.Get("fit"), strings.ToUpper(q.Get("fmt"))
+	sig, err := hex.DecodeString(q.Get("sig"))
+	want, _ := hex.DecodeString(proxySign(p.Key, photoID, ws, hs, q.Get("fit"), q.Get("fmt"), q.Get("exp")))
+	if err != nil || !hmac.Equal(sig, want) {
+		http.Error(w, "bad signature", http.StatusForbidden)
+		return
+	}
+	exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	left := exp - time.Now().Unix()
+	if err != nil || left <= 0 {
+		http.Error(w, "expired", http.StatusForbidden)
+		return
+	}
+	maxAge := int64(p.MaxAge)
+	if left < maxAge {
+		maxAge = left
+	}
+
+	if strings.Count(photoID, ".") != 1 || strings.Contains(photoID, "/") {
+		http.Error(w, "bad photo id", http.StatusBadRequest)
+		return
+	}
+	if !p.sizes[ws+"x"+hs] {
+		http.Error(w, "size not allowed", http.StatusBadRequest)
+		return
+	}
+	width, height, _ := parseSize(ws + "x" + hs)
+	switch fit {
+	case "":
+		fit = fitFill
+	case fitInside, fitFill, fitExact, fitSmart:
+	default:
+		http.Error(w, "unknown fit mode", http.StatusBadRequest)
+		return
+	}
+	if format == "" {
+		format = p.Formats[0]
+	}
+	ok := false
+	for _, f := range p.Formats {
+		if f == format {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		http.Error(w, "format not allowed", http.StatusBadRequest)
+		return
+	}
+
+	rend := &Rendition{
+		Suffix: fmt.Sprintf("%s%dx%d-%s", derivedSuffix, width, height, fit),
+		Width:  width,
+		Height: height,
+		Fit:    fit,
+		Format: format,
+		// Watermark stays false, see above.
+	}
+	name := rend.objectName(photoID, rend.Format)
+	rl := newRequestLog(r, cfg.OutputBucket, name)
+
+	if !flight.begin() {
+		busy(w, "shutting down")
+		return
+	}
+	defer flight.end()
+
+	// A hit is served straight from the bucket.
+	if info, err := store.Stat(cfg.OutputBucket, name); err == nil {
+		proxyRequests.add("hit", 1)
+		serveDerived(w, r, name, info.Updated, maxAge, nil)
+		return
+	} else if err != blobstore.ErrNotExist {
+		rl.Errorf("stat: %v", err)
+	}
+
+	var blob []byte
+	done := make(chan bool)
+	if !workers.submit(func() {
+		defer close(done)
+		start := time.Now()
+		blob, err = renderDerived(rl, cfg, photoID, name, rend)
+		rl.Done(start, err)
+	}) {
+		busy(w, "too many images in the queue")
+		return
+	}
+	<-done
+	switch {
+	case err == blobstore.ErrNotExist:
+		proxyRequests.add("missing", 1)
+		http.NotFound(w, r)
+	case err != nil:
+		proxyRequests.add("error", 1)
+		if _, ok := err.(*rejectError); ok {
+			http.Error(w, err.Error(), statusRejected)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		proxyRequests.add("miss", 1)
+		serveDerived(w, r, name, time.Now(), maxAge, blob)
+	}
+}
+
+// renderDerived renders an on-demand rendition from the original and keeps it in the bucket.
+func renderDerived(rl *requestLog, cfg *Config, photoID, name string, rend *Rendition) ([]byte, error) {
+	original, err := findOriginal(cfg.Proxy.InputBucket, photoID)
+	if err != nil {
+		return nil, err
+	}
+	r, err := store.Get(cfg.Proxy.InputBucket, original)
+	if err != nil {
+		return nil, err
+	}
+	img, err := readLimited(r, &cfg.Limits)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkImage(img, &cfg.Limits); err != nil {
+		return nil, err
+	}
+
+	wand := imagick.NewMagickWand()
+	defer func() { wand.Destroy() }()
+	if err := wand.ReadImageBlob(img); err != nil {
+		return nil, reject("decode: %v", err)
+	}
+	if wand, _, err = coalesce(rl, wand, &cfg.Animation, cfg.Limits.MaxPixels); err != nil {
+		return nil, err
+	}
+	if err := eachFrame(wand, func() error {
+		stripPrivate(wand)
+		return autoOrient(wand)
+	}); err != nil {
+		return nil, err
+	}
+	wand.SetGravity(imagick.GRAVITY_CENTER)
+
+	encodeStart := time.Now()
+	if err := resizeFrames(wand, rend); err != nil {
+		return nil, fmt.Errorf("resize %s: %v", rend.Suffix, err)
+	}
+	blob, err := encode(wand, rend.Format, cfg.quality(rend, rend.Format))
+	if err != nil {
+		return nil, err
+	}
+	encodeLatency.since("od", encodeStart)
+
+	if err := store.Put(cfg.OutputBucket, name, "image/"+rend.Ext(), bytes.NewReader(blob)); err != nil {
+		// We still have the rendition, the next request will try to keep it again.
+		rl.Errorf("write %s: %v", name, err)
+	}
+	rl.Infof("rendered %s, %d bytes", name, len(blob))
+	return blob, nil
+}
+
+// findOriginal returns the name of the upload of photoID, whatever its extension.
+func findOriginal(bucket, photoID string) (string, error) {
+	names, err := store.List(bucket, photoID+".")
+	if err != nil {
+		return "", fmt.Errorf("list originals: %v", err)
+	}
+	for _, n := range names {
+		if !strings.Contains(strings.TrimPrefix(n, photoID+"."), ".") {
+			return n, nil
+		}
+	}
+	return "", blobstore.ErrNotExist
+}
+
+// serveDerived replies with the rendition, read from the bucket if blob is nil.  The ETag
+// changes whenever the rendition is written again, clients may keep it for maxAge seconds.
+func serveDerived(w http.ResponseWriter, r *http.Request, name string, updated time.Time, maxAge int64, blob []byte) {
+	sum := sha1.Sum([]byte(name + "@" + strconv.FormatInt(updated.UnixNano(), 10)))
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+	for _, t := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if strings.TrimSpace(t) == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	h.Set("Content-Type", "image/"+name[strings.LastIndex(name, ".")+1:])
+
+	if blob != nil {
+		h.Set("Content-Length", strconv.Itoa(len(blob)))
+		if r.Method != "HEAD" {
+			w.Write(blob)
+		}
+		return
+	}
+	rc, err := store.Get(currentConfig().OutputBucket, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+	if r.Method != "HEAD" {
+		io.Copy(w, rc)
+	}
+}
+
+// purgeDerived removes the on-demand renditions of an original, called when it is processed
+// again as they would be of the previous upload.
+func purgeDerived(bucket, base string) error {
+	names, err := store.List(bucket, base+"_"+derivedSuffix)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if err := store.Delete(bucket, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestProxyRejects(t *testing.T) {
+	configMu.Lock()
+	saved := config
+	config = &Config{Proxy: Proxy{Key: "k", InputBucket: "in", Sizes: []string{"320x320"}}}
+	if err := config.Proxy.validate(); err != nil {
+		t.Fatal(err)
+	}
+	configMu.Unlock()
+	defer func() {
+		configMu.Lock()
+		config = saved
+		configMu.Unlock()
+	}()
+
+	const photo = "1234.5678"
+	later := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	earlier := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	signed := func(w, h, exp string) url.Values {
+		return url.Values{"w": {w}, "h": {h}, "fmt": {"webp"}, "exp": {exp},
+			"sig": {proxySign("k", photo, w, h, "", "webp", exp)}}
+	}
+	for _, tt := range []struct {
+		name   string
+		q      url.Values
+		status int
+	}{
+		{"unsigned", url.Values{"w": {"320"}, "h": {"320"}, "exp": {later}}, http.StatusForbidden},
+		{"other key", url.Values{"w": {"320"}, "h": {"320"}, "fmt": {"webp"}, "exp": {later},
+			"sig": {proxySign("x", photo, "320", "320", "", "webp", later)}}, http.StatusForbidden},
+		{"expired", signed("320", "320", earlier), http.StatusForbidden},
+		{"no expiry", signed("320", "320", ""), http.StatusForbidden},
+		{"size", signed("640", "640", later), http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/img/"+photo+"?"+tt.q.Encode(), nil)
+		proxyHandler(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/gographics/imagick/imagick"
+)
+
+// Defaults of the watermark, used when the config leaves them out.
+const (
+	defaultWatermarkOpacity    = 0.5
+	defaultWatermarkImageScale = 0.25 // of the shorter side, for the width of the image
+	defaultWatermarkTextScale  = 0.05 // of the shorter side, for the height of the text
+	defaultWatermarkMargin     = 0.02
+)
+
+// gravities are the positions a watermark can be put at.
+var gravities = map[string]imagick.GravityType{
+	"northwest": imagick.GRAVITY_NORTH_WEST,
+	"north":     imagick.GRAVITY_NORTH,
+	"northeast": imagick.GRAVITY_NORTH_EAST,
+	"west":      imagick.GRAVITY_WEST,
+	"center":    imagick.GRAVITY_CENTER,
+	"east":      imagick.GRAVITY_EAST,
+	"southwest": imagick.GRAVITY_SOUTH_WEST,
+	"south":     imagick.GRAVITY_SOUTH,
+	"southeast": imagick.GRAVITY_SOUTH_EAST,
+}
+
+// Watermark is composited on the renditions marked for it, the ones shared outside the app.  It
+// is an image, or the display name of the owner when there's no image.  Owners can opt out.
+type Watermark struct {
+	Image    string  // path of the image, PNG with transparency works best
+	Text     bool    // write the owner's display name when there's no Image
+	Font     string  // ImageMagick font name of the text, empty for the ImageMagick default
+	Position string  // one of the gravities above, defaults to southeast
+	Opacity  float64 // 0-1, defaults to 0.5
+	Scale    float64 // width of the image, or height of the text, as a fraction of the shorter side
+	Margin   float64 // gap to the edges, as a fraction of the shorter side, defaults to 0.02
+
+	gravity imagick.GravityType
+}
+
+func (w *Watermark) enabled() bool {
+	return w.Image != "" || w.Text
+}
+
+func (w *Watermark) validate() error {
+	if !w.enabled() {
+		return nil
+	}
+	if w.Position == "" {
+		w.Position = "southeast"
+	}
+	g, ok := gravities[strings.ToLower(w.Position)]
+	if !ok {
+		return fmt.Errorf("unknown position %q", w.Position)
+	}
+	w.gravity = g
+	if w.Opacity < 0 || w.Opacity > 1 || w.Scale < 0 || w.Scale > 1 || w.Margin < 0 || w.Margin > 0.5 {
+		return fmt.Errorf("opacity, scale or margin out of range")
+	}
+	if w.Opacity == 0 {
+		w.Opacity = defaultWatermarkOpacity
+	}
+	if w.Scale == 0 {
+		w.Scale = defaultWatermarkImageScale
+		if w.Image == "" {
+			w.Scale = defaultWatermarkTextScale
+		}
+	}
+	if w.Margin == 0 {
+		w.Margin = defaultWatermarkMargin
+	}
+	return nil
+}
+
+// mark is the watermark of a single photo.
+type mark struct {
+	image *imagick.MagickWand // nil for text
+	text  string
+}
+
+// clone returns a copy of the watermark for a goroutine of its own, nil if there is none.
+func (m *mark) clone() *mark {
+	if m == nil {
+		return nil
+	}
+	c := &mark{text: m.text}
+	if m.image != nil {
+		c.image = m.image.Clone()
+	}
+	return c
+}
+
+func (m *mark) destroy() {
+	if m != nil && m.image != nil {
+		m.image.Destroy()
+	}
+}
+
+// attribution is what endpoints tells us about the owner of a photo.
+type attribution struct {
+	Name      string `json:"name"`
+	Watermark bool   `json:"watermark"` // false if the owner opted out
+}
+
+// newMark returns the watermark of the photo, nil if it doesn't get one.
+func newMark(rl *requestLog, cfg *Config, name, token string) (*mark, error) {
+	wm := &cfg.Watermark
+	if !wm.enabled() {
+		return nil, nil
+	}
+	wanted := false
+	for _, r := range cfg.Renditions {
+		if r.Watermark {
+			wanted = true
+			break
+		}
+	}
+	if !wanted {
+		return nil, nil
+	}
+
+	attr, err := fetchAttribution(rl, name, token)
+	if err != nil {
+		return nil, err
+	}
+	if !attr.Watermark {
+		rl.Infof("owner opted out of the watermark")
+		return nil, nil
+	}
+	if wm.Image == "" {
+		if attr.Name == "" {
+			return nil, nil
+		}
+		return &mark{text: attr.Name}, nil
+	}
+	img := imagick.NewMagickWand()
+	if err := img.ReadImage(wm.Image); err != nil {
+		img.Destroy()
+		return nil, fmt.Errorf("read %s: %v", wm.Image, err)
+	}
+	return &mark{image: img}, nil
+}
+
+// fetchAttribution asks endpoints who owns the photo and whether they want the watermark.
+func fetchAttribution(rl *requestLog, name, token string) (*attribution, error) {
+	if sep := strings.LastIndex(name, "."); sep >= 0 {
+		name = name[:sep]
+	}
+	req, err := http.NewRequest("GET", currentConfig().PushURL+name+"/attribution", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", token)
+	req.Header.Set(traceHeader, rl.trace)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("attribution: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("attribution status: %v", res.Status)
+	}
+	var attr attribution
+	if err := json.NewDecoder(res.Body).Decode(&attr); err != nil {
+		return nil, fmt.Errorf("attribution: %v", err)
+	}
+	return &attr, nil
+}
+
+// applyMark composites the watermark on a rendition.  The watermark image is only read, but
+// renditions rendered at once each need their own copy of it, see mark.clone.
+func applyMark(wand *imagick.MagickWand, m *mark, wm *Watermark) error {
+	w, h := wand.GetImageWidth(), wand.GetImageHeight()
+	short := math.Min(float64(w), float64(h))
+	margin := int(wm.Margin * short)
+
+	if m.image == nil {
+		dw := imagick.NewDrawingWand()
+		defer dw.Destroy()
+		fill := imagick.NewPixelWand()
+		defer fill.Destroy()
+		fill.SetColor(fmt.Sprintf("rgba(255,255,255,%.2f)", wm.Opacity))
+		dw.SetFillColor(fill)
+		if wm.Font != "" {
+			if err := dw.SetFont(wm.Font); err != nil {
+				return fmt.Errorf("font: %v", err)
+			}
+		}
+		dw.SetFontSize(wm.Scale * short)
+		dw.SetTextAntialias(true)
+		dw.SetGravity(wm.gravity)
+		// With a gravity the offsets are from the edges it points at.
+		return wand.AnnotateImage(dw, float64(margin), float64(margin), 0, m.text)
+	}
+
+	img := m.image.Clone()
+	defer img.Destroy()
+	box := uint(wm.Scale*short + 0.5)
+	iw, ih := scaleTo(img.GetImageWidth(), img.GetImageHeight(), box, box, false)
+	if err := img.ResizeImage(iw, ih, imagick.FILTER_LANCZOS, 1); err != nil {
+		return fmt.Errorf("resize watermark: %v", err)
+	}
+	if wm.Opacity < 1 {
+		if err := img.SetImageAlphaChannel(imagick.ALPHA_CHANNEL_SET); err != nil {
+			return err
+		}
+		if err := img.EvaluateImageChannel(imagick.CHANNEL_ALPHA, imagick.EVAL_OP_MULTIPLY, wm.Opacity); err != nil {
+			return fmt.Errorf("watermark opacity: %v", err)
+		}
+	}
+	x, y := place(wm.gravity, w, h, iw, ih, margin)
+	return wand.CompositeImage(img, imagick.COMPOSITE_OP_OVER, x, y)
+}
+
+// place returns the offset of a w x h watermark in a bw x bh image, at the gravity and margin
+// away from the edges it points at.
+func place(g imagick.GravityType, bw, bh, w, h uint, margin int) (x, y int) {
+	x, y = int(bw-w)/2, int(bh-h)/2
+	switch g {
+	case imagick.GRAVITY_NORTH_WEST, imagick.GRAVITY_WEST, imagick.GRAVITY_SOUTH_WEST:
+		x = margin
+	case imagick.GRAVITY_NORTH_EAST, imagick.GRAVITY_EAST, imagick.GRAVITY_SOUTH_EAST:
+		x = int(bw) - int(w) - margin
+	}
+	switch g {
+	case imagick.GRAVITY_NORTH_WEST, imagick.GRAVITY_NORTH, imagick.GRAVITY_NORTH_EAST:
+		y = margin
+	case imagick.GRAVITY_SOUTH_WEST, imagick.GRAVITY_SOUTH, imagick.GRAVITY_SOUTH_EAST:
+		y = int(bh) - int(h) - margin
+	}
+	return x, y
+}
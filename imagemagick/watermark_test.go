@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gographics/imagick/imagick"
+)
+
+func TestPlace(t *testing.T) {
+	for _, tt := range []struct {
+		g      imagick.GravityType
+		bw, bh uint // the rendition
+		w, h   uint // the watermark
+		x, y   int
+	}{
+		// landscape
+		{imagick.GRAVITY_SOUTH_EAST, 400, 300, 100, 20, 294, 274},
+		{imagick.GRAVITY_NORTH_WEST, 400, 300, 100, 20, 6, 6},
+		{imagick.GRAVITY_NORTH, 400, 300, 100, 20, 150, 6},
+		{imagick.GRAVITY_EAST, 400, 300, 100, 20, 294, 140},
+		{imagick.GRAVITY_CENTER, 400, 300, 100, 20, 150, 140},
+		{imagick.GRAVITY_SOUTH, 400, 300, 100, 20, 150, 274},
+		// portrait
+		{imagick.GRAVITY_SOUTH_EAST, 300, 400, 75, 15, 219, 379},
+		{imagick.GRAVITY_NORTH_EAST, 300, 400, 75, 15, 219, 6},
+		{imagick.GRAVITY_SOUTH_WEST, 300, 400, 75, 15, 6, 379},
+		{imagick.GRAVITY_WEST, 300, 400, 75, 15, 6, 192},
+		{imagick.GRAVITY_CENTER, 300, 400, 75, 15, 112, 192},
+	} {
+		if x, y := place(tt.g, tt.bw, tt.bh, tt.w, tt.h, 6); x != tt.x || y != tt.y {
+			t.Errorf("place(%v, %dx%d in %dx%d) = %d,%d, want %d,%d", tt.g, tt.w, tt.h, tt.bw, tt.bh, x, y, tt.x, tt.y)
+		}
+	}
+}
+
+// The fixtures are flat grey but for their checkerboard, a red square watermark is easy to spot.
+func TestApplyMark(t *testing.T) {
+	red := imagick.NewPixelWand()
+	defer red.Destroy()
+	red.SetColor("red")
+	img := imagick.NewMagickWand()
+	if err := img.NewImage(40, 40, red); err != nil {
+		t.Fatal(err)
+	}
+	m := &mark{image: img}
+	defer m.destroy()
+
+	wm := &Watermark{Image: "red.png", Opacity: 1}
+	if err := wm.validate(); err != nil {
+		t.Fatal(err)
+	}
+	// The watermark is a quarter of the shorter side, 75 pixels, 6 pixels away from the edges.
+	for _, tt := range []struct {
+		fixture    string
+		inX, inY   int // in the watermark
+		outX, outY int // just outside it
+	}{
+		{"landscape.png", 356, 256, 356, 210},
+		{"portrait.png", 256, 356, 210, 356},
+	} {
+		wand := readFixture(t, tt.fixture)
+		err := applyMark(wand, m, wm)
+		if err != nil {
+			wand.Destroy()
+			t.Errorf("%s: %v", tt.fixture, err)
+			continue
+		}
+		for _, p := range []struct {
+			x, y int
+			red  bool
+		}{
+			{tt.inX, tt.inY, true},
+			{tt.outX, tt.outY, false},
+			{20, 20, false},
+		} {
+			c, err := wand.GetImagePixelColor(p.x, p.y)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.fixture, err)
+			}
+			isRed := c.GetRed() > 0.9 && c.GetGreen() < 0.1
+			c.Destroy()
+			if isRed != p.red {
+				t.Errorf("%s: pixel %d,%d red %v, want %v", tt.fixture, p.x, p.y, isRed, p.red)
+			}
+		}
+		wand.Destroy()
+	}
+}
+
+func TestShippedWatermark(t *testing.T) {
+	cfg, err := loadConfig("config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Watermark.enabled() {
+		t.Error("config.json ships without a watermark")
+	}
+	var marked []string
+	for _, r := range cfg.Renditions {
+		if r.Watermark {
+			marked = append(marked, r.Suffix)
+		}
+	}
+	if len(marked) == 0 {
+		t.Error("config.json marks no share size for the watermark")
+	}
+}
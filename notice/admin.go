@@ -0,0 +1,95 @@
+package notice
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// The admin handlers are restricted to the administrators of the application in app.yaml.
+
+func init() {
+	http.Handle("/notice/admin/failures", errorHandler(failuresHandler))
+	http.Handle("/notice/admin/redrive", errorHandler(redriveHandler))
+}
+
+// failure is a dead lettered task, as listed by failuresHandler.
+type failure struct {
+	ID       string    `json:"id"`
+	Bucket   string    `json:"bucket"`
+	Name     string    `json:"name"`
+	Event    string    `json:"event"`
+	Attempts int       `json:"attempts"`
+	Reason   string    `json:"reason"`
+	Date     time.Time `json:"date"`
+}
+
+// failuresHandler lists the dead lettered tasks, most recent first.
+func failuresHandler(w http.ResponseWriter, r *http.Request) error {
+	c := appengine.NewContext(r)
+	var dls []DeadLetter
+	keys, err := datastore.NewQuery("DeadLetter").Order("-Date").Limit(500).GetAll(c, &dls)
+	if err != nil {
+		return fmt.Errorf("list dead letters: %v", err)
+	}
+	pkeys := make([]*datastore.Key, len(keys))
+	for i, k := range keys {
+		pkeys[i] = k.Parent()
+	}
+	ps := make([]Processing, len(keys))
+	if err := datastore.GetMulti(c, pkeys, ps); err != nil {
+		return fmt.Errorf("get ledger: %v", err)
+	}
+
+	fs := make([]failure, len(keys))
+	for i, p := range ps {
+		fs[i] = failure{
+			ID:       pkeys[i].StringID(),
+			Bucket:   p.Bucket,
+			Name:     p.Name,
+			Event:    p.Event,
+			Attempts: p.Attempts,
+			Reason:   dls[i].Reason,
+			Date:     dls[i].Date,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(fs)
+}
+
+// redriveHandler queues dead lettered tasks again, the ones given as id parameters or all of
+// them with all=1.
+func redriveHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return nil
+	}
+	c := appengine.NewContext(r)
+	r.ParseForm()
+	ids := r.Form["id"]
+	if r.FormValue("all") == "1" {
+		keys, err := datastore.NewQuery("DeadLetter").KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return fmt.Errorf("list dead letters: %v", err)
+		}
+		for _, k := range keys {
+			ids = append(ids, k.Parent().StringID())
+		}
+	}
+
+	n := 0
+	for _, id := range ids {
+		if err := redrive(c, id); err != nil {
+			c.Errorf("redrive %v: %v", id, err)
+			fmt.Fprintf(w, "%v: %v\n", id, err)
+			continue
+		}
+		n++
+	}
+	fmt.Fprintf(w, "re-drove %d of %d\n", n, len(ids))
+	return nil
+}
@@ -0,0 +1,226 @@
+package notice
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/memcache"
+	"appengine/urlfetch"
+)
+
+// Config lists the imagemagick backends we spread the images over.
+type Config struct {
+	Backends     []string // base URLs, they must be https with a certificate matching the host
+	DevBackends  []string // used instead under the development server
+	EjectSeconds int      // how long a backend that failed a call is left out, defaults to 60
+
+	// Credentials of the notifications.  Pub/Sub push requests must carry an OpenID Connect token
+	// for PushAudience issued to PushServiceAccount, legacy notifications the ChannelToken given
+	// when the channel was created, they are refused without one.  DevChannelToken is used
+	// instead under the development server.
+	PushAudience       string
+	PushServiceAccount string
+	ChannelToken       string
+	DevChannelToken    string
+
+	UploadsBucket string // the bucket clients upload to, notifications for any other are refused
+}
+
+var config, configErr = loadConfig("config.json")
+
+// loadConfig reads the configuration, it ships with the module so a file we can't read or parse
+// is fatal.  One that doesn't validate is returned along with the error: the instance still
+// starts, its tasks fail and are retried until the configuration is fixed and deployed.
+func loadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("can't read notice config in file %q: %v", path, err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		log.Fatalf("error parsing notice config in file %q: %v", path, err)
+	}
+	if err := cfg.validate(appengine.IsDevAppServer()); err != nil {
+		err = fmt.Errorf("notice config in file %q: %v", path, err)
+		log.Print(err)
+		return &cfg, err
+	}
+	return &cfg, nil
+}
+
+// validate checks the configuration and fills in the defaults.
+func (c *Config) validate(dev bool) error {
+	if c.EjectSeconds <= 0 {
+		c.EjectSeconds = 60
+	}
+	if dev {
+		c.ChannelToken = c.DevChannelToken
+	}
+	if c.UploadsBucket == "" {
+		return fmt.Errorf("no UploadsBucket")
+	}
+	list, name := c.Backends, "Backends"
+	if dev {
+		list, name = c.DevBackends, "DevBackends"
+	}
+	if len(list) == 0 {
+		return fmt.Errorf("no %s", name)
+	}
+	for _, b := range list {
+		u, err := url.Parse(b)
+		if err != nil || u.Host == "" || strings.ContainsAny(u.Host, "<> ") || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("%s: %q isn't the base URL of a backend", name, b)
+		}
+		if u.Scheme != "https" && !(dev && u.Scheme == "http") {
+			return fmt.Errorf("%s: %q must be https", name, b)
+		}
+	}
+	return nil
+}
+
+// The health of the backends is shared by the instances through memcache: a backend is down while
+// there's a downKey for it.  The health check cron job sets and clears them, and calls that fail
+// set them for EjectSeconds.  Losing the keys only means trying a bad backend once more.
+const (
+	downKey = "backend:down:"
+	nextKey = "backend:next"
+
+	// healthCheckDown is how long a failed health check keeps a backend out, a bit longer than the
+	// cron period so it stays out until a check passes.
+	healthCheckDown = 90 * time.Second
+)
+
+func backends(c appengine.Context) []string {
+	if appengine.IsDevAppServer() {
+		return config.DevBackends
+	}
+	return config.Backends
+}
+
+// healthy returns the backends that aren't down.
+func healthy(c appengine.Context) []string {
+	all := backends(c)
+	keys := make([]string, len(all))
+	for i, b := range all {
+		keys[i] = downKey + b
+	}
+	items, err := memcache.GetMulti(c, keys)
+	if err != nil {
+		c.Warningf("backend health: %v", err)
+		return all
+	}
+	down := make(map[string]bool)
+	for _, b := range all {
+		if _, ok := items[downKey+b]; ok {
+			down[b] = true
+		}
+	}
+	if len(down) == len(all) && len(all) > 0 {
+		c.Warningf("all backends are down, trying them anyway")
+	}
+	return upBackends(all, down)
+}
+
+// upBackends returns the backends of all that aren't down.  If they all are we try them all
+// anyway, there's nothing else to do and the task queue will back off for us.
+func upBackends(all []string, down map[string]bool) []string {
+	var up []string
+	for _, b := range all {
+		if !down[b] {
+			up = append(up, b)
+		}
+	}
+	if len(up) == 0 {
+		return all
+	}
+	return up
+}
+
+// pickBackend returns the next healthy backend, round-robin across all our instances.
+func pickBackend(c appengine.Context) (string, error) {
+	if configErr != nil {
+		return "", configErr
+	}
+	up := healthy(c)
+	if len(up) == 0 {
+		return "", fmt.Errorf("no backends configured")
+	}
+	n, err := memcache.Increment(c, nextKey, 1, uint64(rand.Intn(len(up))))
+	if err != nil {
+		c.Warningf("backend round-robin: %v", err)
+		n = uint64(rand.Intn(len(up)))
+	}
+	return roundRobin(up, n), nil
+}
+
+// roundRobin returns the backend of turn n.
+func roundRobin(up []string, n uint64) string {
+	return up[n%uint64(len(up))]
+}
+
+// markDown leaves the backend out for d.
+func markDown(c appengine.Context, backend string, d time.Duration) {
+	err := memcache.Set(c, &memcache.Item{Key: downKey + backend, Value: []byte{}, Expiration: d})
+	if err != nil {
+		c.Errorf("mark %v down: %v", backend, err)
+	}
+}
+
+// eject is called when a call to backend failed.
+func eject(c appengine.Context, backend string) {
+	c.Warningf("ejecting backend %v for %vs", backend, config.EjectSeconds)
+	markDown(c, backend, time.Duration(config.EjectSeconds)*time.Second)
+}
+
+// healthCheckHandler is run by cron, it checks every backend and updates their health.
+func healthCheckHandler(w http.ResponseWriter, r *http.Request) error {
+	c := appengine.NewContext(r)
+	if r.Header.Get("X-Appengine-Cron") != "true" && !appengine.IsDevAppServer() {
+		return &authError{"health checks are only run by cron"}
+	}
+	if configErr != nil {
+		return configErr
+	}
+	client := http.Client{Transport: &urlfetch.Transport{Context: c, Deadline: 10 * time.Second}}
+
+	checkBackends(&client, backends(c), func(b string, err error) {
+		if err != nil {
+			c.Warningf("backend %v unhealthy: %v", b, err)
+			markDown(c, b, healthCheckDown)
+			fmt.Fprintf(w, "%v down: %v\n", b, err)
+			return
+		}
+		if err := memcache.Delete(c, downKey+b); err != nil && err != memcache.ErrCacheMiss {
+			c.Errorf("mark %v up: %v", b, err)
+		}
+		fmt.Fprintf(w, "%v up\n", b)
+	})
+	return nil
+}
+
+// checkBackends runs the health check of every backend, report is called with the outcome of each.
+func checkBackends(client *http.Client, all []string, report func(backend string, err error)) {
+	for _, b := range all {
+		report(b, checkBackend(client, b))
+	}
+}
+
+func checkBackend(client *http.Client, backend string) error {
+	res, err := client.Get(backend + "/healthcheck")
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v", res.Status)
+	}
+	return nil
+}
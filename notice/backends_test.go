@@ -0,0 +1,115 @@
+package notice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	for _, tt := range []struct {
+		cfg Config
+		dev bool
+		err string
+	}{
+		{Config{UploadsBucket: "in", Backends: []string{"https://im-1.example.com:8443"}}, false, ""},
+		{Config{UploadsBucket: "in", Backends: []string{"https://im-1.example.com:8443/"}}, false, ""},
+		{Config{UploadsBucket: "in", DevBackends: []string{"http://localhost:8090"}}, true, ""},
+		{Config{UploadsBucket: "in"}, false, "no Backends"},
+		{Config{Backends: []string{"https://im-1.example.com"}}, false, "no UploadsBucket"},
+		{Config{UploadsBucket: "in", Backends: []string{"https://im-1.example.com"}}, true, "no DevBackends"},
+		{Config{UploadsBucket: "in", Backends: []string{"https://<imagemagick host>:8443"}}, false, "isn't the base URL"},
+		{Config{UploadsBucket: "in", Backends: []string{"https://im-1.example.com/img"}}, false, "isn't the base URL"},
+		{Config{UploadsBucket: "in", Backends: []string{"http://im-1.example.com"}}, false, "must be https"},
+	} {
+		err := tt.cfg.validate(tt.dev)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%+v: got error %v, want %q", tt.cfg, err, tt.err)
+		}
+	}
+	cfg := Config{UploadsBucket: "in", Backends: []string{"https://im-1.example.com"}}
+	cfg.validate(false)
+	if cfg.EjectSeconds != 60 {
+		t.Errorf("EjectSeconds defaults to %d, want 60", cfg.EjectSeconds)
+	}
+	for _, dev := range []bool{false, true} {
+		cfg := Config{UploadsBucket: "in", Backends: []string{"https://im-1.example.com"},
+			DevBackends: []string{"http://localhost:8090"}, ChannelToken: "prod", DevChannelToken: "dev"}
+		cfg.validate(dev)
+		if want := map[bool]string{false: "prod", true: "dev"}[dev]; cfg.ChannelToken != want {
+			t.Errorf("dev %v: ChannelToken %q, want %q", dev, cfg.ChannelToken, want)
+		}
+	}
+}
+
+// A configuration without backends leaves the instance running, the tasks fail with its error.
+func TestLoadConfigInvalid(t *testing.T) {
+	cfg, err := loadConfig("testdata/config-no-backends.json")
+	if err == nil || !strings.Contains(err.Error(), "Backends") {
+		t.Errorf("got error %v, want no backends", err)
+	}
+	if cfg == nil || cfg.UploadsBucket != "abelana-in" {
+		t.Errorf("got config %+v", cfg)
+	}
+}
+
+// fakeBackend answers the health check with status.
+func fakeBackend(status int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthcheck" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+}
+
+func TestBackendSelection(t *testing.T) {
+	up1, up2 := fakeBackend(http.StatusOK), fakeBackend(http.StatusOK)
+	defer up1.Close()
+	defer up2.Close()
+	full := fakeBackend(http.StatusServiceUnavailable)
+	defer full.Close()
+	gone := fakeBackend(http.StatusOK)
+	gone.Close() // refuses connections
+	all := []string{up1.URL, full.URL, up2.URL, gone.URL}
+
+	down := make(map[string]bool)
+	checkBackends(http.DefaultClient, all, func(b string, err error) {
+		if err != nil {
+			down[b] = true
+		}
+	})
+	if want := map[string]bool{full.URL: true, gone.URL: true}; !reflect.DeepEqual(down, want) {
+		t.Fatalf("down after the health check: %v, want %v", down, want)
+	}
+
+	up := upBackends(all, down)
+	if want := []string{up1.URL, up2.URL}; !reflect.DeepEqual(up, want) {
+		t.Fatalf("up: %v, want %v", up, want)
+	}
+	count := make(map[string]int)
+	for n := uint64(0); n < 10; n++ {
+		count[roundRobin(up, n)]++
+	}
+	if count[up1.URL] != 5 || count[up2.URL] != 5 {
+		t.Errorf("round-robin over %v: %v, want 5 each", up, count)
+	}
+
+	// A failed call ejects the backend, the others take its turns.
+	down[up1.URL] = true
+	up = upBackends(all, down)
+	for n := uint64(0); n < 4; n++ {
+		if b := roundRobin(up, n); b != up2.URL {
+			t.Errorf("turn %d went to %v with only %v up", n, b, up2.URL)
+		}
+	}
+
+	// With every backend down they are all tried.
+	down[up2.URL] = true
+	if up = upBackends(all, down); !reflect.DeepEqual(up, all) {
+		t.Errorf("all down: %v, want %v", up, all)
+	}
+}
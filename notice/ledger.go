@@ -0,0 +1,265 @@
+package notice
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+)
+
+// The ledger has an entry per event and object generation, it is what makes sure every upload is
+// processed once even when notifications are duplicated and tasks retried.
+//
+// Datastore:
+// Processing >> DeadLetter
+const (
+	stateReceived   = "received"   // notified, the task is queued
+	stateProcessing = "processing" // a backend is working on it
+	stateDone       = "done"
+	stateFailed     = "failed" // rejected by the backend, or out of retries
+)
+
+const (
+	// taskQueue is where images are processed, maxTaskRetries and taskAgeLimit its
+	// task_retry_limit and task_age_limit in queue.yaml.  The queue retries a task until both are
+	// reached, so a backend too busy for it doesn't use up its retries.
+	taskQueue      = "new-images"
+	maxTaskRetries = 5
+	taskAgeLimit   = 48 * time.Hour
+
+	retryCountHeader = "X-AppEngine-TaskRetryCount"
+)
+
+// Processing is the ledger entry of an object generation.
+type Processing struct {
+	Bucket     string
+	Name       string
+	Generation string
+	Event      string
+	State      string
+	Attempts   int
+	LastError  string `datastore:",noindex"`
+	Created    time.Time
+	Updated    time.Time
+
+	// TraceID is in the logs of every service that handled the upload.
+	TraceID string
+
+	// Where the time of the last attempt went, in milliseconds.
+	WaitMs    int64 // from the notification to the start of the attempt, in the task queue
+	BackendMs int64 // the call to imagemagick, the steps below and endpoints' photopush included
+	ReadMs    int64 `datastore:",noindex"` // reading the original
+	DecodeMs  int64 `datastore:",noindex"` // decoding, orienting and stripping it
+	RenderMs  int64 `datastore:",noindex"` // resizing, encoding and writing the renditions
+	PushMs    int64 `datastore:",noindex"` // telling endpoints
+}
+
+// attempt is the outcome of running a task once.
+type attempt struct {
+	state     string
+	status    int // of the backend reply
+	err       error
+	busy      bool // the backend had no room for it, the attempt doesn't count
+	backendMs int64
+	hops      map[string]int64 // steps timed by the backend
+}
+
+// DeadLetter keeps a task that ran out of retries so it can be re-driven.
+type DeadLetter struct {
+	Path   string // of the task
+	Form   string `datastore:",noindex"` // URL encoded parameters of the task
+	Reason string `datastore:",noindex"`
+	Date   time.Time
+}
+
+// ledgerID identifies an event on an object generation.
+func ledgerID(event, bucket, name, generation string) string {
+	return event + ":" + bucket + "/" + name + "#" + generation
+}
+
+func ledgerKey(c appengine.Context, id string) *datastore.Key {
+	return datastore.NewKey(c, "Processing", id, 0, nil)
+}
+
+func deadLetterKey(c appengine.Context, id string) *datastore.Key {
+	return datastore.NewKey(c, "DeadLetter", "dead", 0, ledgerKey(c, id))
+}
+
+// taskPath is the handler processing each kind of event.
+func taskPath(event string) string {
+	if event == eventDelete {
+		return "/notice/deleted-image"
+	}
+	return "/notice/incoming-image"
+}
+
+// record adds n to the ledger and queues its task, both or neither.  It reports false for
+// notifications we've already had.
+func record(c appengine.Context, n *notification) (bool, error) {
+	id := ledgerID(n.Event, n.Bucket, n.Name, n.Generation)
+	// The trace id is that of the request which first notified us.
+	trace := appengine.RequestID(c)
+	form := url.Values{
+		"bucket":     {n.Bucket},
+		"name":       {n.Name},
+		"generation": {n.Generation},
+		"event":      {n.Event},
+		"trace":      {trace},
+	}
+	isNew := false
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		k := ledgerKey(tc, id)
+		var p Processing
+		switch err := datastore.Get(tc, k, &p); err {
+		case nil:
+			isNew = false
+			return nil
+		case datastore.ErrNoSuchEntity:
+		default:
+			return err
+		}
+		now := time.Now().UTC()
+		p = Processing{
+			Bucket:     n.Bucket,
+			Name:       n.Name,
+			Generation: n.Generation,
+			Event:      n.Event,
+			State:      stateReceived,
+			Created:    now,
+			Updated:    now,
+			TraceID:    trace,
+		}
+		if _, err := datastore.Put(tc, k, &p); err != nil {
+			return err
+		}
+		if _, err := taskqueue.Add(tc, taskqueue.NewPOSTTask(taskPath(n.Event), form), taskQueue); err != nil {
+			return err
+		}
+		isNew = true
+		return nil
+	}, nil)
+	if err != nil {
+		return false, fmt.Errorf("record %v: %v", id, err)
+	}
+	return isNew, nil
+}
+
+// startAttempt marks the entry as processing, unless it's already over in which case its State is
+// the one it ended in and the task has nothing left to do.  It returns the entry as it was.
+func startAttempt(c appengine.Context, id, trace string, form url.Values) (*Processing, error) {
+	var p Processing
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		k := ledgerKey(tc, id)
+		p = Processing{}
+		switch err := datastore.Get(tc, k, &p); err {
+		case nil:
+		case datastore.ErrNoSuchEntity:
+			// queued before we kept a ledger
+			p = Processing{
+				Bucket:     form.Get("bucket"),
+				Name:       form.Get("name"),
+				Generation: form.Get("generation"),
+				Event:      form.Get("event"),
+				Created:    time.Now().UTC(),
+				TraceID:    trace,
+			}
+		default:
+			return err
+		}
+		if p.State == stateDone || p.State == stateFailed {
+			return nil
+		}
+		started := p
+		started.State = stateProcessing
+		started.Attempts++
+		started.Updated = time.Now().UTC()
+		started.WaitMs = int64(started.Updated.Sub(started.Created) / time.Millisecond)
+		_, err := datastore.Put(tc, k, &started)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("start %v: %v", id, err)
+	}
+	return &p, nil
+}
+
+// finish records the outcome of an attempt.  A failed attempt with retries left goes back to
+// received, one without is dead lettered with the path and form of its task.
+func finish(c appengine.Context, id string, a *attempt, path string, form url.Values) error {
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		k := ledgerKey(tc, id)
+		var p Processing
+		if err := datastore.Get(tc, k, &p); err != nil {
+			return err
+		}
+		p.State = a.state
+		if a.busy {
+			p.Attempts--
+		}
+		p.Updated = time.Now().UTC()
+		if a.err != nil {
+			p.LastError = a.err.Error()
+		}
+		p.BackendMs = a.backendMs
+		p.ReadMs, p.DecodeMs = a.hops["read"], a.hops["decode"]
+		p.RenderMs, p.PushMs = a.hops["render"], a.hops["push"]
+		if _, err := datastore.Put(tc, k, &p); err != nil {
+			return err
+		}
+		if a.state != stateFailed || path == "" {
+			return nil
+		}
+		d := &DeadLetter{Path: path, Form: form.Encode(), Reason: p.LastError, Date: p.Updated}
+		_, err := datastore.Put(tc, deadLetterKey(tc, id), d)
+		return err
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("finish %v: %v", id, err)
+	}
+	return nil
+}
+
+// redrive queues a dead lettered task again, with a fresh set of retries.
+func redrive(c appengine.Context, id string) error {
+	return datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		var d DeadLetter
+		if err := datastore.Get(tc, deadLetterKey(tc, id), &d); err != nil {
+			return err
+		}
+		var p Processing
+		k := ledgerKey(tc, id)
+		if err := datastore.Get(tc, k, &p); err != nil {
+			return err
+		}
+		form, err := url.ParseQuery(d.Form)
+		if err != nil {
+			return err
+		}
+		if _, err := taskqueue.Add(tc, taskqueue.NewPOSTTask(d.Path, form), taskQueue); err != nil {
+			return err
+		}
+		p.State = stateReceived
+		p.Attempts = 0
+		p.Updated = time.Now().UTC()
+		if _, err := datastore.Put(tc, k, &p); err != nil {
+			return err
+		}
+		return datastore.Delete(tc, deadLetterKey(tc, id))
+	}, nil)
+}
+
+// lastAttempt reports whether a failed attempt at the task of p is its last: it failed as many
+// times as the queue retries it, or the queue won't retry it, given its retryCountHeader.
+func lastAttempt(p *Processing, retryCount string, now time.Time) bool {
+	return p.Attempts >= maxTaskRetries || queueGivesUp(p, retryCount, now)
+}
+
+// queueGivesUp reports whether the queue won't retry the task of p: it is past both limits.
+func queueGivesUp(p *Processing, retryCount string, now time.Time) bool {
+	n, err := strconv.Atoi(retryCount)
+	return err == nil && n >= maxTaskRetries && now.Sub(p.Created) >= taskAgeLimit
+}
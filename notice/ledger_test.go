@@ -0,0 +1,34 @@
+package notice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLastAttempt(t *testing.T) {
+	now := time.Date(2019, 2, 1, 9, 0, 0, 0, time.UTC)
+	young, old := now.Add(-time.Hour), now.Add(-taskAgeLimit)
+	for _, tt := range []struct {
+		name       string
+		attempts   int // counted before this one
+		retryCount string
+		created    time.Time
+		last, gone bool
+	}{
+		{"first", 0, "0", young, false, false},
+		{"out of retries", maxTaskRetries, "5", young, true, false},
+		// busy attempts don't count, the queue keeps retrying until the task is old too
+		{"busy for a while", 1, "9", young, false, false},
+		{"busy for too long", 1, "9", old, true, true},
+		{"old but few retries", 1, "2", old, false, false},
+		{"no header", 0, "", old, false, false},
+	} {
+		p := &Processing{Attempts: tt.attempts, Created: tt.created}
+		if got := lastAttempt(p, tt.retryCount, now); got != tt.last {
+			t.Errorf("%s: lastAttempt %v, want %v", tt.name, got, tt.last)
+		}
+		if got := queueGivesUp(p, tt.retryCount, now); got != tt.gone {
+			t.Errorf("%s: queueGivesUp %v, want %v", tt.name, got, tt.gone)
+		}
+	}
+}
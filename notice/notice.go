@@ -3,65 +3,62 @@ package notice
 import (
 	"encoding/json"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/golang/oauth2/google"
 
 	"appengine"
-	"appengine/memcache"
-	"appengine/taskqueue"
 	"appengine/urlfetch"
 )
 
-const backendAddress = "http://146.148.74.233:8080"
+// statusRejected is what the backend replies for images it will never be able to process, it has
+// already told endpoints so there's no point in retrying.
+const statusRejected = 422
+
+// traceHeader carries the id we give an upload when first notified, imagemagick passes it on to
+// endpoints so the logs of every service can be matched.
+const traceHeader = "X-Trace-Id"
 
 func init() {
 	http.Handle("/", errorHandler(bucketNotificationHandler))
 	http.Handle("/notice/incoming-image", errorHandler(incomingImageHandler))
+	http.Handle("/notice/deleted-image", errorHandler(deletedImageHandler))
+	http.Handle("/notice/healthcheck", errorHandler(healthCheckHandler))
 }
 
 func bucketNotificationHandler(w http.ResponseWriter, r *http.Request) error {
 	c := appengine.NewContext(r)
 
-	// Decode the name and bucket of the notification
-	var n struct {
-		Name   string `json:"name"`
-		Bucket string `json:"bucket"`
-	}
-	err := json.NewDecoder(r.Body).Decode(&n)
+	n, err := parseNotification(c, r)
 	if err != nil {
-		return fmt.Errorf("invalid notification: %v", err)
+		return err
 	}
-
-	// handle duplicated notifications, drop keys after 5 minutes
-	item := &memcache.Item{
-		Key:        "notify:" + n.Bucket + "/" + n.Name,
-		Expiration: 5 * time.Minute,
-		Value:      []byte{},
+	if n == nil {
+		fmt.Fprintln(w, "ignored")
+		return nil
 	}
-	switch err := memcache.Add(c, item); err {
-	case memcache.ErrNotStored:
-		// the key existed already, dup notification
-		c.Infof("duplicated notification for %q", item.Key)
+	if n.Event == eventDelete && n.Overwritten {
+		// the new generation has its own notification and will be processed again
+		c.Infof("%v/%v#%v overwritten", n.Bucket, n.Name, n.Generation)
+		fmt.Fprintln(w, "OK")
 		return nil
-	case nil:
-		c.Infof("first time notification for %q", item.Key)
-		// first time we see this key
-	default:
-		c.Errorf("add notification to memcache: %v", err)
 	}
 
-	// Add a new task to the queue
-	t := taskqueue.NewPOSTTask("/notice/incoming-image", map[string][]string{
-		"bucket": {n.Bucket},
-		"name":   {n.Name},
-	})
-	_, err = taskqueue.Add(c, t, "new-images")
+	// The ledger drops duplicated notifications, the generation is part of its key so that
+	// overwriting a photo gets it processed again.
+	isNew, err := record(c, n)
 	if err != nil {
-		return fmt.Errorf("add task to queue: %v", err)
+		return err
+	}
+	if !isNew {
+		c.Infof("duplicated notification for %v/%v#%v", n.Bucket, n.Name, n.Generation)
+	} else {
+		c.Infof("trace %v: %v %v/%v#%v", appengine.RequestID(c), n.Event, n.Bucket, n.Name, n.Generation)
 	}
 
 	fmt.Fprintln(w, "OK")
@@ -69,38 +66,200 @@ func bucketNotificationHandler(w http.ResponseWriter, r *http.Request) error {
 }
 
 func incomingImageHandler(w http.ResponseWriter, r *http.Request) error {
+	return processTask(w, r, "/")
+}
+
+// deletedImageHandler has the backend remove the renditions of a deleted image.
+func deletedImageHandler(w http.ResponseWriter, r *http.Request) error {
+	return processTask(w, r, "/delete")
+}
+
+// processTask has a backend handle the task, at most once successfully, and records the outcome
+// in the ledger.
+func processTask(w http.ResponseWriter, r *http.Request, path string) error {
 	c := appengine.NewContext(r)
-	config := google.NewAppEngineConfig(c, "https://www.googleapis.com/auth/userinfo.email")
-	config.Transport = &urlfetch.Transport{
-		Context:                       c,
-		Deadline:                      time.Minute,
-		AllowInvalidServerCertificate: true,
+	r.ParseForm()
+	if b := r.FormValue("bucket"); b != config.UploadsBucket {
+		// Only our own tasks get here, but a delete would retire the photo of whoever has the name.
+		return &authError{fmt.Sprintf("task for bucket %q, we only handle %v", b, config.UploadsBucket)}
+	}
+	id := ledgerID(r.FormValue("event"), r.FormValue("bucket"), r.FormValue("name"), r.FormValue("generation"))
+	trace := r.FormValue("trace")
+	if trace == "" {
+		// queued before we traced uploads
+		trace = appengine.RequestID(c)
 	}
-	client := http.Client{Transport: config.NewTransport()}
 
-	r.ParseForm()
-	res, err := client.PostForm(backendAddress, r.Form)
+	p, err := startAttempt(c, id, trace, r.Form)
+	if err != nil {
+		return err
+	}
+	if p.State == stateDone || p.State == stateFailed {
+		c.Infof("trace %v: %v already %v", trace, id, p.State)
+		fmt.Fprintln(w, p.State)
+		return nil
+	}
+
+	if r.FormValue("event") != eventDelete {
+		reportProcessing(c, r.FormValue("name"), trace)
+	}
+
+	start := time.Now()
+	a := &attempt{}
+	a.status, a.hops, a.err = callBackend(c, path, trace, r.Form)
+	a.backendMs = int64(time.Since(start) / time.Millisecond)
+	c.Infof("trace %v: %v backend took %vms %v", trace, id, a.backendMs, a.hops)
+
+	switch {
+	case a.err == nil:
+		a.state = stateDone
+		if err := finish(c, id, a, "", nil); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "OK")
+	case a.status == statusRejected:
+		c.Warningf("trace %v: backend rejected %v/%v", trace, r.FormValue("bucket"), r.FormValue("name"))
+		a.state = stateFailed
+		if err := finish(c, id, a, "", nil); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "rejected")
+	case a.status == http.StatusServiceUnavailable && !queueGivesUp(p, r.Header.Get(retryCountHeader), time.Now()):
+		// The backend is busy, the queue backs off and tries again without using up a retry.
+		c.Warningf("trace %v: %v backend busy: %v", trace, id, a.err)
+		a.state, a.busy = stateReceived, true
+		if err := finish(c, id, a, "", nil); err != nil {
+			c.Errorf("%v", err)
+		}
+		return a.err
+	case a.status == http.StatusServiceUnavailable || lastAttempt(p, r.Header.Get(retryCountHeader), time.Now()):
+		c.Errorf("trace %v: %v out of retries, dead lettered: %v", trace, id, a.err)
+		a.state = stateFailed
+		if err := finish(c, id, a, path, r.Form); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "dead lettered")
+	default:
+		a.state = stateReceived
+		if err := finish(c, id, a, "", nil); err != nil {
+			c.Errorf("%v", err)
+		}
+		return a.err
+	}
+	return nil
+}
+
+// callBackend posts form to path on one of the backends.  It returns the status of the reply,
+// the time the backend spent in each step, and an error unless it was a 200.
+func callBackend(c appengine.Context, path, trace string, form url.Values) (int, map[string]int64, error) {
+	client := appClient(c, time.Minute)
+
+	backend, err := pickBackend(c)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	req, err := http.NewRequest("POST", backend+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, nil, fmt.Errorf("backend request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(traceHeader, trace)
+	res, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("backend: %v", err)
+		// The task will be retried, most likely on another backend.
+		eject(c, backend)
+		return 0, nil, fmt.Errorf("backend %v: %v", backend, err)
 	}
+	defer res.Body.Close()
 
+	if res.StatusCode == statusRejected {
+		b, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, nil, fmt.Errorf("rejected: %s", strings.TrimSpace(string(b)))
+	}
+	if res.StatusCode == http.StatusServiceUnavailable {
+		b, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, nil, fmt.Errorf("backend %v: %s", backend, strings.TrimSpace(string(b)))
+	}
 	if res.StatusCode != http.StatusOK {
 		b, err := httputil.DumpResponse(res, true)
 		if err != nil {
-			return fmt.Errorf("dump response: %v", err)
+			return res.StatusCode, nil, fmt.Errorf("dump response: %v", err)
 		}
-		c.Errorf("backend failed with code %v:\n%s", res.Status, b)
+		c.Errorf("trace %v: backend failed with code %v:\n%s", trace, res.Status, b)
+		return res.StatusCode, nil, fmt.Errorf("backend %v: %v", backend, res.Status)
+	}
+
+	// Older backends reply "ok", they don't time their steps.
+	var body struct {
+		Hops map[string]int64 `json:"hops"`
 	}
+	json.NewDecoder(res.Body).Decode(&body)
+	return res.StatusCode, body.Hops, nil
+}
+
+// appClient makes calls authenticated as the application, which is who imagemagick and the
+// photopush calls of endpoints accept.
+func appClient(c appengine.Context, deadline time.Duration) *http.Client {
+	oc := google.NewAppEngineConfig(c, "https://www.googleapis.com/auth/userinfo.email")
+	oc.Transport = &urlfetch.Transport{
+		Context:  c,
+		Deadline: deadline,
+	}
+	return &http.Client{Transport: oc.NewTransport()}
+}
 
-	w.WriteHeader(res.StatusCode)
-	_, err = io.Copy(w, res.Body)
-	return err
+// reportProcessing tells endpoints the photo is being processed, so that the uploader can follow
+// along.  It's best effort, the photo is processed regardless.
+func reportProcessing(c appengine.Context, name, trace string) {
+	host, err := appengine.ModuleHostname(c, "endpoints", "", "")
+	if err != nil {
+		c.Warningf("trace %v: endpoints hostname: %v", trace, err)
+		return
+	}
+	scheme := "https://"
+	if appengine.IsDevAppServer() {
+		scheme = "http://"
+	}
+	// drop the file extension
+	if sep := strings.LastIndex(name, "."); sep >= 0 {
+		name = name[:sep]
+	}
+	req, err := http.NewRequest("POST", scheme+host+"/photopush/"+name+"/processing", nil)
+	if err != nil {
+		c.Warningf("trace %v: processing request: %v", trace, err)
+		return
+	}
+	req.Header.Set(traceHeader, trace)
+	res, err := appClient(c, 5*time.Second).Do(req)
+	if err != nil {
+		c.Warningf("trace %v: report processing: %v", trace, err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		c.Warningf("trace %v: report processing: %v", trace, res.Status)
+	}
 }
 
 type errorHandler func(http.ResponseWriter, *http.Request) error
 
+// authError is returned for callers that didn't prove who they are.
+type authError struct {
+	msg string
+}
+
+func (e *authError) Error() string {
+	return e.msg
+}
+
 func (h errorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	err := h(w, r)
+	if _, ok := err.(*authError); ok {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		appengine.NewContext(r).Warningf(err.Error())
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		appengine.NewContext(r).Errorf(err.Error())
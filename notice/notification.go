@@ -0,0 +1,183 @@
+package notice
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"appengine"
+	"appengine/urlfetch"
+)
+
+// Events we act upon, named after the Pub/Sub notification event types.
+const (
+	eventFinalize = "OBJECT_FINALIZE" // a new object, or a new generation of an existing one
+	eventDelete   = "OBJECT_DELETE"
+)
+
+// notification is what we need from either kind of Cloud Storage notification.
+type notification struct {
+	Bucket     string
+	Name       string
+	Generation string // the generation created, or deleted
+	Event      string
+	// Overwritten is set for the deletion of a generation replaced by a new one, it's only
+	// known for Pub/Sub notifications.
+	Overwritten bool
+}
+
+// Legacy Object Change Notifications are the object resource, with the kind of change in a header.
+const (
+	resourceStateHeader = "X-Goog-Resource-State"
+	channelTokenHeader  = "X-Goog-Channel-Token"
+)
+
+// pushMessage is the body of a Pub/Sub push request.
+type pushMessage struct {
+	Message struct {
+		Attributes map[string]string `json:"attributes"`
+		Data       string            `json:"data"`
+		MessageID  string            `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// parseNotification decodes either kind of notification, checking the credentials that come with
+// it.  It returns a nil notification for the events we ignore.
+func parseNotification(c appengine.Context, r *http.Request) (*notification, error) {
+	var body struct {
+		pushMessage
+		Name       string `json:"name"`
+		Bucket     string `json:"bucket"`
+		Generation string `json:"generation"`
+		Updated    string `json:"updated"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid notification: %v", err)
+	}
+
+	if body.Subscription != "" {
+		if err := verifyPush(c, r); err != nil {
+			return nil, err
+		}
+		n, err := pubSubNotification(&body.pushMessage)
+		if err != nil || n == nil {
+			return nil, err
+		}
+		if err := checkBucket(n); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+
+	// A legacy channel is only as private as its token, without one anybody could post to us.
+	if config.ChannelToken == "" {
+		return nil, &authError{"legacy notifications need a ChannelToken"}
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(channelTokenHeader)), []byte(config.ChannelToken)) != 1 {
+		return nil, &authError{"bad channel token"}
+	}
+	n := &notification{Bucket: body.Bucket, Name: body.Name, Generation: body.Generation}
+	if n.Generation == "" {
+		// without it the ledger would take every later upload under the name for a duplicate
+		n.Generation = body.Updated
+	}
+	switch r.Header.Get(resourceStateHeader) {
+	case "exists", "": // notifications without the header predate it, they were all uploads
+		n.Event = eventFinalize
+	case "not_exists":
+		n.Event = eventDelete
+	default: // sync
+		return nil, nil
+	}
+	if err := checkBucket(n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func pubSubNotification(m *pushMessage) (*notification, error) {
+	attrs := m.Message.Attributes
+	n := &notification{
+		Bucket:     attrs["bucketId"],
+		Name:       attrs["objectId"],
+		Generation: attrs["objectGeneration"],
+		Event:      attrs["eventType"],
+
+		Overwritten: attrs["overwrittenByGeneration"] != "",
+	}
+	if n.Event != eventFinalize && n.Event != eventDelete {
+		// metadata updates and archival don't change the pixels
+		return nil, nil
+	}
+	if n.Bucket == "" || n.Name == "" {
+		// JSON_API_V1 payloads also carry the object resource
+		b, err := base64.StdEncoding.DecodeString(m.Message.Data)
+		if err != nil {
+			return nil, fmt.Errorf("message %v: bad data: %v", m.Message.MessageID, err)
+		}
+		var obj struct {
+			Name       string `json:"name"`
+			Bucket     string `json:"bucket"`
+			Generation string `json:"generation"`
+		}
+		if err := json.Unmarshal(b, &obj); err != nil {
+			return nil, fmt.Errorf("message %v: bad object: %v", m.Message.MessageID, err)
+		}
+		n.Bucket, n.Name, n.Generation = obj.Bucket, obj.Name, obj.Generation
+	}
+	if n.Bucket == "" || n.Name == "" {
+		return nil, fmt.Errorf("message %v: no object", m.Message.MessageID)
+	}
+	return n, nil
+}
+
+// checkBucket refuses notifications for objects outside the uploads bucket, their renditions
+// would be written and pushed under the id of whoever's photo has the name.
+func checkBucket(n *notification) error {
+	if n.Bucket != config.UploadsBucket {
+		return &authError{fmt.Sprintf("notification for %v/%v, we only handle %v", n.Bucket, n.Name, config.UploadsBucket)}
+	}
+	return nil
+}
+
+// verifyPush checks the credentials of a push request, tests stand in for the token info endpoint.
+var verifyPush = authorizePush
+
+// authorizePush checks the OpenID Connect token the push subscription sends was issued to its
+// service account for our audience.
+func authorizePush(c appengine.Context, r *http.Request) error {
+	if config.PushServiceAccount == "" || config.PushAudience == "" {
+		return &authError{"push notifications aren't configured"}
+	}
+	fs := strings.Fields(r.Header.Get("Authorization"))
+	if len(fs) != 2 || fs[0] != "Bearer" {
+		return &authError{"push without credentials"}
+	}
+
+	client := urlfetch.Client(c)
+	res, err := client.Get("https://oauth2.googleapis.com/tokeninfo?id_token=" + url.QueryEscape(fs[1]))
+	if err != nil {
+		return fmt.Errorf("token info: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return &authError{"push token rejected: " + res.Status}
+	}
+	var tok struct {
+		Aud           string `json:"aud"`
+		Email         string `json:"email"`
+		EmailVerified string `json:"email_verified"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tok); err != nil {
+		return fmt.Errorf("token info: %v", err)
+	}
+	if tok.Aud != config.PushAudience || tok.Email != config.PushServiceAccount || tok.EmailVerified != "true" {
+		return &authError{fmt.Sprintf("push token for %v %v not accepted", tok.Email, tok.Aud)}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package notice
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"appengine"
+)
+
+// The fixtures in testdata are notifications as Cloud Storage sends them for the uploads bucket,
+// ocn-* through a legacy channel and pubsub-* through a push subscription.
+
+func TestParseNotification(t *testing.T) {
+	defer func(cfg *Config, verify func(appengine.Context, *http.Request) error) {
+		config, verifyPush = cfg, verify
+	}(config, verifyPush)
+	config = &Config{UploadsBucket: "abelana-in", ChannelToken: "s3cret"}
+	verifyPush = func(c appengine.Context, r *http.Request) error {
+		if r.Header.Get("Authorization") != "Bearer good" {
+			return &authError{"push token rejected"}
+		}
+		return nil
+	}
+
+	const (
+		name = "1234.5678.jpg"
+		gen  = "1476791234567000"
+	)
+	for _, tt := range []struct {
+		fixture string
+		header  map[string]string
+		want    *notification
+		authErr bool
+	}{
+		{
+			fixture: "ocn-finalize",
+			header:  map[string]string{resourceStateHeader: "exists", channelTokenHeader: "s3cret"},
+			want:    &notification{Bucket: "abelana-in", Name: name, Generation: gen, Event: eventFinalize},
+		},
+		{
+			fixture: "ocn-delete",
+			header:  map[string]string{resourceStateHeader: "not_exists", channelTokenHeader: "s3cret"},
+			want:    &notification{Bucket: "abelana-in", Name: name, Generation: gen, Event: eventDelete},
+		},
+		{
+			fixture: "ocn-finalize",
+			header:  map[string]string{resourceStateHeader: "sync", channelTokenHeader: "s3cret"},
+		},
+		{
+			fixture: "pubsub-finalize",
+			header:  map[string]string{"Authorization": "Bearer good"},
+			want:    &notification{Bucket: "abelana-in", Name: name, Generation: gen, Event: eventFinalize},
+		},
+		{
+			fixture: "pubsub-data-only",
+			header:  map[string]string{"Authorization": "Bearer good"},
+			want:    &notification{Bucket: "abelana-in", Name: name, Generation: gen, Event: eventFinalize},
+		},
+		{
+			fixture: "pubsub-delete",
+			header:  map[string]string{"Authorization": "Bearer good"},
+			want:    &notification{Bucket: "abelana-in", Name: name, Generation: gen, Event: eventDelete},
+		},
+		{
+			fixture: "pubsub-overwritten",
+			header:  map[string]string{"Authorization": "Bearer good"},
+			want:    &notification{Bucket: "abelana-in", Name: name, Generation: gen, Event: eventDelete, Overwritten: true},
+		},
+		{
+			fixture: "pubsub-metadata",
+			header:  map[string]string{"Authorization": "Bearer good"},
+		},
+
+		// bad auth
+		{fixture: "ocn-finalize", header: map[string]string{channelTokenHeader: "guess"}, authErr: true},
+		{fixture: "ocn-delete", header: map[string]string{resourceStateHeader: "not_exists"}, authErr: true},
+		{fixture: "pubsub-finalize", header: map[string]string{"Authorization": "Bearer bad"}, authErr: true},
+		{fixture: "pubsub-finalize", authErr: true},
+
+		// other buckets
+		{fixture: "ocn-other-bucket", header: map[string]string{channelTokenHeader: "s3cret"}, authErr: true},
+		{fixture: "pubsub-other-bucket", header: map[string]string{"Authorization": "Bearer good"}, authErr: true},
+	} {
+		b, err := ioutil.ReadFile("testdata/" + tt.fixture + ".json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := http.NewRequest("POST", "/", bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range tt.header {
+			r.Header.Set(k, v)
+		}
+
+		n, err := parseNotification(nil, r)
+		if tt.authErr {
+			if _, ok := err.(*authError); !ok {
+				t.Errorf("%s %v: got %+v, %v, want an authError", tt.fixture, tt.header, n, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %v: %v", tt.fixture, tt.header, err)
+			continue
+		}
+		if !reflect.DeepEqual(n, tt.want) {
+			t.Errorf("%s %v: got %+v, want %+v", tt.fixture, tt.header, n, tt.want)
+		}
+	}
+}
+
+func TestLegacyNeedsChannelToken(t *testing.T) {
+	defer func(cfg *Config) { config = cfg }(config)
+	config = &Config{UploadsBucket: "abelana-in"}
+
+	b, err := ioutil.ReadFile("testdata/ocn-finalize.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := http.NewRequest("POST", "/", bytes.NewReader(b))
+	r.Header.Set(resourceStateHeader, "exists")
+	if n, err := parseNotification(nil, r); err == nil {
+		t.Errorf("accepted %+v without a ChannelToken configured", n)
+	}
+}